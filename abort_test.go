@@ -0,0 +1,274 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// abortedStream writes data to dest in MinFrameSize frames and aborts it
+func abortedStream(id MsgId, dest string, data string, reason error) chan *Frame {
+	frames := make(chan *Frame, 16)
+	stream := NewWriteStream(id, MustParseDestination(dest), frames)
+	stream.SetFrameSize(MinFrameSize)
+	stream.Write([]byte(data))
+	stream.Abort(reason)
+	close(frames)
+	return frames
+}
+
+func TestStreamAbort(t *testing.T) {
+	InitFrameBuffers()
+	data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)
+	stream, err := NewReadStream(abortedStream(CreateMid(0, 0, 1), "s:/test", data, errors.New("Disk full")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(&stream)
+	if aborted, ok := err.(*AbortError); !ok || aborted.Reason != "Disk full" {
+		t.Errorf("Expected the stream aborted, got %v", err)
+	}
+	// Only the full frames were sent before the abort
+	if !strings.HasPrefix(data, string(received)) || len(received) == 0 || len(received) == len(data) {
+		t.Errorf("Expected the first frames of the stream, got %q", received)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected reads past the abort to fail")
+	}
+	// Aborted before anything was sent, the headers are dropped
+	frames := make(chan *Frame, 4)
+	writer := NewWriteStream(CreateMid(0, 0, 2), MustParseDestination("s:/test"), frames)
+	writer.SetHeader(HEADER_CONTENT_TYPE, "text/plain")
+	writer.Write([]byte("Lorel Ipsum"))
+	writer.Abort(nil)
+	if err := writer.Abort(nil); err == nil {
+		t.Errorf("Expected a second abort to fail")
+	}
+	close(frames)
+	first := <-frames
+	if first.Flags != FIRSTFRAME|LASTFRAME|ABORT || len(first.Contents()) != 0 {
+		t.Errorf("Expected a single abort frame, got %v", first.String())
+	}
+	frames = make(chan *Frame, 1)
+	frames <- first
+	close(frames)
+	stream, _ = NewReadStream(frames)
+	if headers, err := stream.Headers(); err != nil || len(headers) != 0 {
+		t.Errorf("Expected no headers, got %v, %v", headers, err)
+	}
+	if _, err := stream.Read(make([]byte, 16)); err == nil {
+		t.Errorf("Expected the stream aborted")
+	}
+}
+
+func TestSplitAbortFrame(t *testing.T) {
+	InitFrameBuffers()
+	reason := strings.Repeat("r", 1000)
+	f, _ := NewFrame(FrameHeader{Id: CreateMid(0, 0, 1), FrameNumber: 3, Flags: LASTFRAME | ABORT}, []byte(reason))
+	frames, err := f.split(MinFrameSize, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].Flags != LASTFRAME|ABORT || len(frames[0].Contents()) != MinFrameSize-FrameHeaderSize {
+		t.Errorf("Expected the reason truncated in one abort frame, got %v", frames)
+	}
+}
+
+func TestRouterAbort(t *testing.T) {
+	target := &collectingConnection{}
+	dead := &collectingConnection{}
+	deadLetter := "s:/dead"
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/test": Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/dead": Simple{Targets: Addresses{Address{0, 9}}},
+		},
+		DeadLetter: &deadLetter,
+	})
+	router := NewRouter(routing, mapConnectionFactory{Address{0, 1}: target, Address{0, 9}: dead})
+	data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)
+	for f := range abortedStream(CreateMid(0, 0, 1), "s:/test", data, errors.New("Disk full")) {
+		router.Recv() <- f
+	}
+	for f := range abortedStream(CreateMid(0, 0, 2), "s:/nowhere", data, errors.New("Disk full")) {
+		router.Recv() <- f
+	}
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if open := router.OpenStreams(""); len(open) != 0 {
+		t.Errorf("Expected no stream open, got %v", open)
+	}
+	if aborted := router.Metrics().AbortedStreams; aborted != 2 {
+		t.Errorf("Expected 2 aborted streams, got %v", aborted)
+	}
+	for name, c := range map[string]*collectingConnection{"target": target, "dead letter": dead} {
+		c.lock.Lock()
+		if len(c.flags) == 0 || c.flags[len(c.flags)-1]&(LASTFRAME|ABORT) != LASTFRAME|ABORT || !strings.HasSuffix(string(c.contents), "Disk full") {
+			t.Errorf("Expected the %v stream aborted, got %v", name, c.flags)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// abortListener reports the error ending the streams it receives
+type abortListener struct {
+	started chan struct{}
+	errs    chan error
+}
+
+func (a abortListener) OnStream(stream ReadStream) {
+	a.started <- struct{}{}
+	_, err := ioutil.ReadAll(&stream)
+	a.errs <- err
+}
+
+func TestWriterConnectionLost(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/test", Simple{Targets: Addresses{Address{0, 2}}})
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), maxFrameSize: MaxFrameSize}
+	router := NewRouter(routing, factory)
+	defer router.Stop()
+	writer := pipeClient(t, factory, 1, silentListener{})
+	reader := abortListener{started: make(chan struct{}, 1), errs: make(chan error, 1)}
+	pipeClient(t, factory, 2, reader)
+	stream, err := writer.CreateStream("s:/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 200)))
+	select {
+	case <-reader.started:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to reach its target")
+	}
+	// The writer dies mid-stream
+	writer.conn.Close()
+	select {
+	case err := <-reader.errs:
+		if _, ok := err.(*AbortError); !ok {
+			t.Errorf("Expected an AbortError, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to be aborted")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if open := router.OpenStreams(""); len(open) != 0 {
+		t.Errorf("Expected no open stream left, got %v", open)
+	}
+	if m := router.Metrics(); m.AbortedStreams != 1 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+}
+
+// failingReader returns its data, then fails
+type failingReader struct {
+	data *strings.Reader
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	if f.data.Len() == 0 {
+		return 0, errors.New("Disk failure")
+	}
+	return f.data.Read(p)
+}
+
+func TestStreamToAbortsOnReadError(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/test", Simple{Targets: Addresses{Address{0, 2}}})
+	routing.UpsertSimpleRule("s:/silent", Simple{Targets: Addresses{Address{0, 3}}})
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), maxFrameSize: MaxFrameSize}
+	router := NewRouter(routing, factory)
+	defer router.Stop()
+	writer := pipeClient(t, factory, 1, silentListener{})
+	reader := abortListener{started: make(chan struct{}, 1), errs: make(chan error, 1)}
+	pipeClient(t, factory, 2, reader)
+	pipeClient(t, factory, 3, silentListener{})
+	data := strings.NewReader(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 200))
+	if err := writer.StreamTo("s:/test", failingReader{data}); err == nil {
+		t.Error("Expected the read error")
+	}
+	select {
+	case err := <-reader.errs:
+		if abort, ok := err.(*AbortError); !ok || abort.Reason != "Disk failure" {
+			t.Errorf("Expected an AbortError, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to be aborted")
+	}
+	// A request waiting for its reply fails when the connection is lost
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writer.conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := writer.Request(ctx, "s:/silent", strings.NewReader("Lorel Ipsum")); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("Expected the request to fail with the connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to fail at once, waited %v", elapsed)
+	}
+}
+
+func TestWriterTargetLost(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/test", Simple{Targets: Addresses{Address{0, 2}}})
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), maxFrameSize: MaxFrameSize}
+	router := NewRouter(routing, factory)
+	defer router.Stop()
+	writer := pipeClient(t, factory, 1, silentListener{})
+	reader := abortListener{started: make(chan struct{}, 1), errs: make(chan error, 1)}
+	target := pipeClient(t, factory, 2, reader)
+	stream, err := writer.CreateStream("s:/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 200))
+	stream.Write(data)
+	select {
+	case <-reader.started:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to reach its target")
+	}
+	// The only target dies mid-stream, the stream is dropped
+	target.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	stream.Write(data)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := stream.Write(data); err == nil {
+		t.Error("Expected writing to a dropped stream to fail")
+	}
+	if err := stream.Close(); err == nil {
+		t.Error("Expected closing a dropped stream to fail")
+	} else if _, ok := err.(*AbortError); !ok {
+		t.Errorf("Expected an AbortError, got %v", err)
+	}
+	writer.aborts.lock.Lock()
+	defer writer.aborts.lock.Unlock()
+	if reasons := len(writer.aborts.reasons); reasons != 0 {
+		t.Errorf("Expected the dropped stream to be forgotten, got %v", reasons)
+	}
+}
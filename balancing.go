@@ -0,0 +1,140 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Policy selects how new streams are spread across the targets of a rule.
+// Whatever the policy, targets that are down are skipped in favor of the
+// next candidate.
+type Policy string
+
+const (
+	// FAILOVER always prefers the first live target, in declaration order
+	FAILOVER Policy = "failover"
+	// ROUND_ROBIN rotates the preferred target for every new stream
+	ROUND_ROBIN Policy = "roundrobin"
+	// LEAST_QUEUED prefers the live target with the smallest send queue, as
+	// reported by Connection.Queue. It relies on the send buffer of local
+	// connections, LOCAL_SEND_QUEUE frames: unbuffered connections always
+	// report an empty queue and make it behave like FAILOVER.
+	LEAST_QUEUED Policy = "leastqueued"
+	// RANDOM prefers a random target
+	RANDOM Policy = "random"
+	// CONSISTENT_HASH prefers a target derived from the destination, so a
+	// destination keeps hitting the same target while it is live
+	CONSISTENT_HASH Policy = "hash"
+)
+
+func (p Policy) valid() bool {
+	switch p {
+	case "", FAILOVER, ROUND_ROBIN, LEAST_QUEUED, RANDOM, CONSISTENT_HASH:
+		return true
+	}
+	return false
+}
+
+func (p *Policy) UnmarshalJSON(input []byte) error {
+	var s string
+	err := json.Unmarshal(input, &s)
+	if err != nil {
+		return err
+	}
+	if !Policy(s).valid() {
+		return fmt.Errorf("Unknown balancing policy %q", s)
+	}
+	*p = Policy(s)
+	return nil
+}
+
+// balancer holds the balancing state of a Router, it is only used from the
+// router goroutine
+type balancer struct {
+	counters map[string]uint64
+	random   *rand.Rand
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		counters: make(map[string]uint64),
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// order returns the targets of route in order of preference for a new stream
+// to destination, route.Addresses itself is never modified.
+func (b *balancer) order(route Route, destination string) Addresses {
+	addresses := route.Addresses
+	if len(addresses) < 2 {
+		return addresses
+	}
+	switch route.Policy {
+	case ROUND_ROBIN:
+		{
+			next := b.counters[route.Rule]
+			b.counters[route.Rule] = next + 1
+			return rotate(addresses, int(next%uint64(len(addresses))))
+		}
+	case RANDOM:
+		{
+			return rotate(addresses, b.random.Intn(len(addresses)))
+		}
+	case CONSISTENT_HASH:
+		{
+			return rendezvous(addresses, destination)
+		}
+	}
+	return addresses
+}
+
+func rotate(addresses Addresses, start int) Addresses {
+	res := make(Addresses, 0, len(addresses))
+	res = append(res, addresses[start:]...)
+	return append(res, addresses[:start]...)
+}
+
+// rendezvous orders addresses by highest random weight for key, removing a
+// target only moves the keys it was preferred for.
+func rendezvous(addresses Addresses, key string) Addresses {
+	res := make(Addresses, len(addresses))
+	copy(res, addresses)
+	keyHash := hashKey(key)
+	weights := make(map[Address]uint64, len(res))
+	for _, a := range res {
+		weights[a] = mix64(keyHash ^ (uint64(a.Node)<<32 | uint64(a.Process)))
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return weights[res[i]] > weights[res[j]]
+	})
+	return res
+}
+
+// mix64 is the splitmix64 finalizer, it spreads small input differences over
+// all output bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
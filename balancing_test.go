@@ -0,0 +1,109 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+var balancedTargets = Addresses{Address{0, 1}, Address{0, 2}, Address{0, 3}}
+
+func TestRoundRobin(t *testing.T) {
+	b := newBalancer()
+	route := Route{Rule: "s:/test", Addresses: balancedTargets, Policy: ROUND_ROBIN}
+	for i := 0; i < 6; i++ {
+		first := b.order(route, "s:/test")[0]
+		if first != balancedTargets[i%3] {
+			t.Errorf("Iteration %v: expected %v first, got %v", i, balancedTargets[i%3], first)
+		}
+	}
+	if route.Addresses[0] != (Address{0, 1}) {
+		t.Errorf("Rule targets modified: %v", route.Addresses)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	b := newBalancer()
+	route := Route{Rule: "s:/test", Addresses: balancedTargets, Policy: CONSISTENT_HASH}
+	seen := make(map[Address]bool)
+	for i := 0; i < 20; i++ {
+		dest := "s:/test/" + string(rune('a'+i))
+		first := b.order(route, dest)[0]
+		if again := b.order(route, dest)[0]; again != first {
+			t.Errorf("Destination %v moved from %v to %v", dest, first, again)
+		}
+		seen[first] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected destinations to spread across targets, got %v", seen)
+	}
+}
+
+func TestLeastQueued(t *testing.T) {
+	factory := countingConnectionFactory{
+		Address{0, 1}: &countingConnection{ok: true, queue: 5},
+		Address{0, 2}: &countingConnection{ok: true, queue: 1},
+		Address{0, 3}: &countingConnection{ok: false},
+	}
+	routing := staticRouting{Addresses: balancedTargets, Policy: LEAST_QUEUED}
+	router := NewRouter(routing, factory)
+	sendStream(router, CreateMid(0, 0, 1), "s:/test", []byte("Lorel Ipsum"))
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if factory[Address{0, 2}].count() != 1 {
+		t.Errorf("Expected least queued target to receive the stream")
+	}
+}
+
+func TestLeastQueuedLocalConnections(t *testing.T) {
+	InitFrameBuffers()
+	factory := mapConnectionFactory{}
+	var conns []*LocalConnection
+	for _, address := range balancedTargets[:2] {
+		server, client := net.Pipe()
+		defer client.Close()
+		// Not started, the frames stay in the send queue
+		conn := newLocalConnection(server, bufio.NewReader(server), Address{0, 1}, "test", MaxFrameSize, nil, func(*LocalConnection) {})
+		defer conn.Close()
+		factory[address] = conn
+		conns = append(conns, conn)
+	}
+	conns[0].Send(testFrame())
+	routing := staticRouting{Addresses: balancedTargets[:2], Policy: LEAST_QUEUED}
+	router := NewRouter(routing, factory)
+	sendStream(router, CreateMid(0, 0, 1), "s:/test", []byte("Lorel Ipsum"))
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if conns[0].Queue() != 1 || conns[1].Queue() != 1 {
+		t.Errorf("Expected the stream queued on the idle connection, got queues %v and %v", conns[0].Queue(), conns[1].Queue())
+	}
+}
+
+func TestPolicyJSON(t *testing.T) {
+	rule := Simple{}
+	err := json.Unmarshal([]byte(`{"targets":[0.1,0.2],"policy":"roundrobin"}`), &rule)
+	if err != nil || rule.Policy != ROUND_ROBIN {
+		t.Errorf("Expected roundrobin policy, got %v (%v)", rule.Policy, err)
+	}
+	err = json.Unmarshal([]byte(`{"targets":[0.1],"policy":"fastest"}`), &rule)
+	if err == nil {
+		t.Error("Expected unknown policy to be rejected")
+	}
+}
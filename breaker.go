@@ -0,0 +1,190 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Router keeps a circuit per target address. A circuit opens when sends
+// to the target failed BREAKER_FAILURES times in a row, counting the times its
+// connection was found closed, or at once when its send queue reaches
+// BREAKER_QUEUE frames. The target is then left out of the selection for new
+// streams until BREAKER_COOLDOWN has passed, the circuit is then half-open:
+// the next stream sent to the target closes it if it succeeds, and opens it
+// again otherwise. Streams in flight keep their connection.
+
+const (
+	BREAKER_FAILURES = 5
+	BREAKER_QUEUE    = 192
+	BREAKER_COOLDOWN = 5 * time.Second
+)
+
+type CircuitState string
+
+const (
+	CIRCUIT_CLOSED    CircuitState = "closed"
+	CIRCUIT_OPEN      CircuitState = "open"
+	CIRCUIT_HALF_OPEN CircuitState = "halfOpen"
+)
+
+// CircuitBreaker sets the thresholds of the circuits of the router: the
+// consecutive failures and the queue depth opening a circuit, and how long
+// it stays open.
+func CircuitBreaker(failures int, queue int, cooldown time.Duration) RouterOption {
+	return func(r *Router) {
+		r.breakers.failures = failures
+		r.breakers.queue = queue
+		r.breakers.cooldown = cooldown
+	}
+}
+
+// Circuit is the state of the circuit of a target
+type Circuit struct {
+	Address  Address      `json:"address"`
+	State    CircuitState `json:"state"`
+	Failures int          `json:"failures,omitempty"`
+	// Reason is the failure that opened the circuit
+	Reason string `json:"reason,omitempty"`
+	// Retry is when an open circuit becomes half-open
+	Retry time.Time `json:"retry,omitempty"`
+}
+
+// breakers holds the circuits of a Router, they are updated by Router.run
+// and read by Circuits. Addresses without a circuit are closed and have no
+// failure.
+type breakers struct {
+	failures int
+	queue    int
+	cooldown time.Duration
+	circuits map[Address]*Circuit
+	metrics  *RouterMetrics
+	lock     sync.Mutex
+	now      func() time.Time
+}
+
+func newBreakers(metrics *RouterMetrics) *breakers {
+	return &breakers{
+		failures: BREAKER_FAILURES,
+		queue:    BREAKER_QUEUE,
+		cooldown: BREAKER_COOLDOWN,
+		circuits: make(map[Address]*Circuit),
+		metrics:  metrics,
+		now:      time.Now,
+	}
+}
+
+// allow returns an error if new streams must not be sent to address on conn
+func (b *breakers) allow(address Address, conn Connection) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuits[address]
+	if c != nil && c.State == CIRCUIT_OPEN {
+		if b.now().Before(c.Retry) {
+			return fmt.Errorf("Circuit to %v open: %v", address, c.Reason)
+		}
+		c.State = CIRCUIT_HALF_OPEN
+		log.WithField("Address", address).WithField("Reason", c.Reason).Info("Circuit half-open, probing target")
+	}
+	if queue := conn.Queue(); b.queue > 0 && queue >= b.queue {
+		b.open(address, fmt.Sprintf("%v frames queued", queue))
+		return fmt.Errorf("Circuit to %v open: %v frames queued", address, queue)
+	}
+	return nil
+}
+
+// success records a successful send to address
+func (b *breakers) success(address Address) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuits[address]
+	if c == nil {
+		return
+	}
+	if c.State == CIRCUIT_HALF_OPEN {
+		atomic.AddUint64(&b.metrics.CircuitsClosed, 1)
+		log.WithField("Address", address).Info("Circuit closed")
+	}
+	if c.State != CIRCUIT_OPEN {
+		delete(b.circuits, address)
+	}
+}
+
+// failure records a failed send to address, or a closed connection
+func (b *breakers) failure(address Address, err error) {
+	atomic.AddUint64(&b.metrics.SendFailures, 1)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuits[address]
+	if c == nil {
+		c = &Circuit{Address: address, State: CIRCUIT_CLOSED}
+		b.circuits[address] = c
+	}
+	c.Failures++
+	if c.State == CIRCUIT_HALF_OPEN || (c.State == CIRCUIT_CLOSED && c.Failures >= b.failures) {
+		b.open(address, err.Error())
+	}
+}
+
+// open opens the circuit of address, the lock must be held
+func (b *breakers) open(address Address, reason string) {
+	c := b.circuits[address]
+	if c == nil {
+		c = &Circuit{Address: address}
+		b.circuits[address] = c
+	}
+	c.State = CIRCUIT_OPEN
+	c.Reason = reason
+	c.Retry = b.now().Add(b.cooldown)
+	atomic.AddUint64(&b.metrics.CircuitsOpened, 1)
+	log.WithField("Address", address).WithField("Reason", reason).WithField("Failures", c.Failures).WithField("Retry", c.Retry).Warn("Circuit opened, target excluded")
+}
+
+// openCircuits returns the number of circuits not closed
+func (b *breakers) openCircuits() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	res := 0
+	for _, c := range b.circuits {
+		if c.State != CIRCUIT_CLOSED {
+			res++
+		}
+	}
+	return res
+}
+
+// Circuits returns the circuits of the router that are not closed, or that
+// recorded failures
+func (r *Router) Circuits() []Circuit {
+	r.breakers.lock.Lock()
+	res := make([]Circuit, 0, len(r.breakers.circuits))
+	for _, c := range r.breakers.circuits {
+		res = append(res, *c)
+	}
+	r.breakers.lock.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Address.Node != res[j].Address.Node {
+			return res[i].Address.Node < res[j].Address.Node
+		}
+		return res[i].Address.Process < res[j].Address.Process
+	})
+	return res
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// sendFirstFrame sends a single frame stream through the selection of router
+func sendFirstFrame(router Router, route Route) Address {
+	conn, address, err := router.selectConnection(route, "s:/test")
+	if err != nil {
+		return INVALID_ADDRESS
+	}
+	f := testFrame()
+	router.send(f, []Connection{conn}, Addresses{address})
+	return address
+}
+
+func testFrame() *Frame {
+	f, _ := NewFrame(FrameHeader{Id: newDaemonMsgId(), Flags: FIRSTFRAME | LASTFRAME, Dest: "s:/test"}, nil)
+	return &f
+}
+
+func TestCircuitOpensOnFailures(t *testing.T) {
+	InitFrameBuffers()
+	failing := &countingConnection{ok: true, err: errors.New("Broken pipe")}
+	live := &countingConnection{ok: true}
+	factory := countingConnectionFactory{Address{0, 1}: failing, Address{0, 2}: live}
+	route := Route{Addresses: Addresses{Address{0, 1}, Address{0, 2}}}
+	router := NewRouter(staticRouting(route), factory, CircuitBreaker(3, 10, time.Minute))
+	defer router.Stop()
+	now := time.Now()
+	router.breakers.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if a := sendFirstFrame(router, route); a != (Address{0, 1}) {
+			t.Fatalf("Stream %v: expected the failing target before the circuit opens, got %v", i, a)
+		}
+	}
+	if a := sendFirstFrame(router, route); a != (Address{0, 2}) {
+		t.Errorf("Expected the live target once the circuit opened, got %v", a)
+	}
+	circuits := router.Circuits()
+	if len(circuits) != 1 || circuits[0].State != CIRCUIT_OPEN || circuits[0].Reason != "Broken pipe" {
+		t.Errorf("Unexpected circuits %+v", circuits)
+	}
+	if m := router.Metrics(); m.CircuitsOpened != 1 || m.OpenCircuits != 1 || m.SendFailures != 3 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+	// The probe fails and opens the circuit again
+	now = now.Add(time.Minute)
+	if a := sendFirstFrame(router, route); a != (Address{0, 1}) {
+		t.Errorf("Expected a probe of the failing target, got %v", a)
+	}
+	if a := sendFirstFrame(router, route); a != (Address{0, 2}) {
+		t.Errorf("Expected the circuit open after a failed probe, got %v", a)
+	}
+	failing.err = nil
+	now = now.Add(time.Minute)
+	sendFirstFrame(router, route)
+	if a := sendFirstFrame(router, route); a != (Address{0, 1}) {
+		t.Errorf("Expected the circuit closed after a successful probe, got %v", a)
+	}
+	if m := router.Metrics(); m.CircuitsOpened != 2 || m.CircuitsClosed != 1 || m.OpenCircuits != 0 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+	if circuits := router.Circuits(); len(circuits) != 0 {
+		t.Errorf("Expected no circuit left, got %+v", circuits)
+	}
+}
+
+func TestCircuitOpensOnQueueAndClose(t *testing.T) {
+	InitFrameBuffers()
+	queued := &countingConnection{ok: true, queue: 10}
+	flapping := &countingConnection{ok: false}
+	live := &countingConnection{ok: true}
+	factory := countingConnectionFactory{Address{0, 1}: queued, Address{0, 2}: flapping, Address{0, 3}: live}
+	route := Route{Addresses: Addresses{Address{0, 1}, Address{0, 2}, Address{0, 3}}}
+	router := NewRouter(staticRouting(route), factory, CircuitBreaker(2, 10, time.Minute))
+	defer router.Stop()
+	sendFirstFrame(router, route)
+	sendFirstFrame(router, route)
+	// The flapping connection is back but its circuit stays open
+	flapping.ok = true
+	queued.queue = 0
+	if a := sendFirstFrame(router, route); a != (Address{0, 3}) {
+		t.Errorf("Expected the live target, got %v", a)
+	}
+	circuits := router.Circuits()
+	if len(circuits) != 2 || circuits[0].State != CIRCUIT_OPEN || circuits[1].State != CIRCUIT_OPEN {
+		t.Errorf("Unexpected circuits %+v", circuits)
+	}
+}
+
+func TestLocalConnectionSendFails(t *testing.T) {
+	InitFrameBuffers()
+	server, client := net.Pipe()
+	defer client.Close()
+	recv := make(chan *Frame)
+	conn := newLocalConnection(server, bufio.NewReader(server), Address{0, 1}, "test", MaxFrameSize, recv, func(l *LocalConnection) {})
+	conn.start()
+	// Nothing reads the client side, the queue fills up
+	var err error
+	for i := 0; i < LOCAL_SEND_QUEUE+2 && err == nil; i++ {
+		err = conn.Send(testFrame())
+	}
+	if err == nil || conn.Queue() != LOCAL_SEND_QUEUE {
+		t.Errorf("Expected a send timeout on a full queue, got %v with %v queued", err, conn.Queue())
+	}
+	conn.Close()
+	if err := conn.Send(testFrame()); err == nil {
+		t.Errorf("Expected an error sending on a closed connection")
+	}
+}
+
+// slowListener reads the streams it receives slowly and reports their size
+type slowListener struct {
+	sizes chan int
+	errs  chan error
+}
+
+func (s slowListener) OnStream(stream ReadStream) {
+	buffer := make([]byte, 4096)
+	size := 0
+	for {
+		n, err := io.ReadFull(&stream, buffer)
+		size += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			s.errs <- err
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.sizes <- size
+}
+
+func TestLocalConnectionThrottle(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/test", Simple{Targets: Addresses{Address{0, 2}}})
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), maxFrameSize: MaxFrameSize}
+	router := NewRouter(routing, factory)
+	defer router.Stop()
+	writer := pipeClient(t, factory, 1, silentListener{})
+	reader := slowListener{sizes: make(chan int, 1), errs: make(chan error, 1)}
+	pipeClient(t, factory, 2, reader)
+	// The stream is far larger than the send queue of the reader
+	data := bytes.Repeat([]byte("Lorel Ipsum Dolor Sic Amet... "), 1<<15)
+	if err := writer.StreamTo("s:/test", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-reader.sizes:
+		if size != len(data) {
+			t.Errorf("Expected %v bytes, got %v", len(data), size)
+		}
+	case err := <-reader.errs:
+		t.Fatalf("Expected the stream to be read, got %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the stream to be read")
+	}
+	if m := router.Metrics(); m.AbortedTargets != 0 || m.DroppedFrames != 0 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+}
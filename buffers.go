@@ -25,24 +25,33 @@ type BuffersContainer struct {
 	size int
 }
 
+// SizedBuffers pools buffers of several sizes, in ascending order
+type SizedBuffers []BuffersContainer
+
 var (
-	frameBuffers     BuffersContainer
+	frameBuffers     SizedBuffers
 	frameBuffersInit sync.Once
-	frameBuffersSize int = 1024
+	// frameBufferSizes are the buffer sizes of the frame pool and the number
+	// of buffers kept for each of them, most frames are small
+	frameBufferSizes = []struct{ size, pool int }{{256, 1024}, {4096, 256}, {MaxFrameSize, 32}}
 
 	httpBuffers     BuffersContainer
 	httpBuffersInit sync.Once
 	httpBuffersSize int = 1024
 )
 
-func InitFrameBuffers() *BuffersContainer {
+func InitFrameBuffers() *SizedBuffers {
 	frameBuffersInit.Do(func() {
-		frameBuffers = BuffersContainer{bufs: make(chan []byte, frameBuffersSize), size: 256}
-		for i := 0; i < frameBuffersSize/2; i++ {
-			frameBuffers.bufs <- make([]byte, 0, frameBuffers.size)
+		frameBuffers = make(SizedBuffers, len(frameBufferSizes))
+		for i, class := range frameBufferSizes {
+			frameBuffers[i] = BuffersContainer{bufs: make(chan []byte, class.pool), size: class.size}
+		}
+		// Only the small buffers are allocated up front
+		for i := 0; i < frameBufferSizes[0].pool/2; i++ {
+			frameBuffers[0].bufs <- make([]byte, 0, frameBuffers[0].size)
 		}
 		if debug {
-			log.WithField("PoolSize", len(frameBuffers.bufs)).WithField("MaxPoolSize", cap(frameBuffers.bufs)).Debug("Initialized frame buffer pool")
+			log.WithField("PoolSize", len(frameBuffers[0].bufs)).WithField("MaxPoolSize", cap(frameBuffers[0].bufs)).Debug("Initialized frame buffer pool")
 		}
 	})
 	return &frameBuffers
@@ -58,7 +67,29 @@ func InitHttpBuffers() *BuffersContainer {
 			log.WithField("PoolSize", len(httpBuffers.bufs)).WithField("MaxPoolSize", cap(httpBuffers.bufs)).Debug("Initialized http buffer pool")
 		}
 	})
-	return &frameBuffers
+	return &httpBuffers
+}
+
+// Get returns an empty buffer with room for size bytes, from the pool of the
+// smallest buffers large enough
+func (s SizedBuffers) Get(size int) []byte {
+	for _, b := range s {
+		if size <= b.size {
+			return b.Get()
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+// Return gives buf back to the pool of its size, buffers of other sizes are
+// left to the garbage collector
+func (s SizedBuffers) Return(buf []byte) {
+	for _, b := range s {
+		if cap(buf) == b.size {
+			b.Return(buf)
+			return
+		}
+	}
 }
 
 func (b BuffersContainer) Get() []byte {
@@ -75,14 +106,14 @@ func (b BuffersContainer) Get() []byte {
 			if debug {
 				log.WithField("PoolSize", len(b.bufs)).WithField("MaxPoolSize", cap(b.bufs)).Debug("Creating new buffer")
 			}
-			return make([]byte, 0, 256)
+			return make([]byte, 0, b.size)
 		}
 	}
 }
 
 func (b BuffersContainer) Return(buf []byte) {
 	buf = buf[0:0]
-	if cap(buf) == 256 {
+	if cap(buf) == b.size {
 		select {
 		case b.bufs <- buf:
 			{
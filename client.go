@@ -18,82 +18,468 @@ package hyenad
 import "net"
 
 import (
-	"encoding/binary"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io"
+	"io/ioutil"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// DEFAULT_CONTROL_TIMEOUT is the time a client waits for hyenad to answer a
+// control request
+const DEFAULT_CONTROL_TIMEOUT = 5 * time.Second
+
 type HyenaClient struct {
 	address     Address
 	conn        net.Conn
+	reader      *bufio.Reader
+	welcome     Welcome
 	send        chan *Frame
 	handlerChan chan inboundStream
-	nextId      uint64
-	listener    StreamListener
+	// nextId is shared with the copies of the client made by NewHyenaClient
+	nextId   *uint64
+	listener StreamListener
+	replies  *pendingReplies
+	aborts   *writeAborts
 }
 
-func NewHyenaClient(pid uint32, listener StreamListener) (HyenaClient, error) {
-	InitFrameBuffers()
-	res := HyenaClient{}
+// writeAborts records the streams of a client that hyenad dropped, their
+// next writes fail with the reason hyenad gave
+type writeAborts struct {
+	// reasons holds the open streams of the client, with nil until they are
+	// aborted
+	reasons map[MsgId]error
+	lock    sync.Mutex
+}
+
+func (w *writeAborts) open(id MsgId) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.reasons[id] = nil
+}
+
+// abort records the abort of stream id, it returns false if id is not an
+// open stream of the client
+func (w *writeAborts) abort(id MsgId, reason error) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.reasons[id]; !ok {
+		return false
+	}
+	w.reasons[id] = reason
+	return true
+}
+
+func (w *writeAborts) reason(id MsgId) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.reasons[id]
+}
+
+func (w *writeAborts) close(id MsgId) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.reasons, id)
+}
+
+// pendingReplies hands the replies to the requests of a client to the
+// goroutines waiting for them instead of the StreamListener
+type pendingReplies struct {
+	waiting map[MsgId]pendingReply
+	lock    sync.Mutex
+	// lost is closed when the connection to hyenad is lost, the requests
+	// waiting for a reply fail at once
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+type pendingReply struct {
+	replies chan ReadStream
+	// token ends the reply destination of a request, the replies to control
+	// requests have none and must come from hyenad
+	token string
+}
+
+// accepts returns true if stream, sent to a reply destination ending with
+// token, is a genuine reply
+func (p pendingReply) accepts(stream ReadStream, token string) bool {
+	if p.token == "" {
+		id := stream.MessageId()
+		_, pid, _ := id.Split()
+		return token == "" && pid == DAEMON_PID
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1
+}
+
+// expect waits for the reply to the stream id, sent to its ReplyDestination
+// followed by token
+func (p *pendingReplies) expect(id MsgId, token string) chan ReadStream {
+	res := make(chan ReadStream, 1)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.waiting[id] = pendingReply{replies: res, token: token}
+	return res
+}
+
+// cancel stops waiting for the reply to id, a reply delivered to replies but
+// not taken is discarded
+func (p *pendingReplies) cancel(id MsgId, replies chan ReadStream) {
+	p.lock.Lock()
+	delete(p.waiting, id)
+	p.lock.Unlock()
+	select {
+	case reply := <-replies:
+		go discardStream(reply)
+	default:
+	}
+}
+
+// deliver hands stream to the request it replies to. It returns false if
+// stream is not sent to a reply destination, and discards replies no request
+// waits for and forged ones.
+func (p *pendingReplies) deliver(stream ReadStream) bool {
+	id, token, ok := repliedId(stream.Destination())
+	if !ok {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	waiting, ok := p.waiting[id]
+	if ok && waiting.accepts(stream, token) {
+		delete(p.waiting, id)
+		waiting.replies <- stream
+		return true
+	}
+	log.WithField("StreamId", stream.MessageId()).WithField("Destination", stream.Destination()).Warn("Discarding unexpected reply")
+	go discardStream(stream)
+	return true
+}
+
+// connectionLost fails the requests waiting for a reply
+func (p *pendingReplies) connectionLost() {
+	p.lostOnce.Do(func() {
+		close(p.lost)
+	})
+}
+
+// wait returns the reply sent to replies, or an error when the connection
+// is lost or done is closed first, reason returns the error of done
+func (p *pendingReplies) wait(replies chan ReadStream, done <-chan struct{}, reason func() error) (ReadStream, error) {
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-p.lost:
+		// A reply delivered before the loss is still valid
+		select {
+		case reply := <-replies:
+			return reply, nil
+		default:
+			return ReadStream{}, errors.New("Connection to hyenad lost")
+		}
+	case <-done:
+		return ReadStream{}, reason()
+	}
+}
+
+// discardStream reads stream to its end, releasing its frames
+func discardStream(stream ReadStream) {
+	io.Copy(ioutil.Discard, contentsReader{&stream})
+}
+
+// newReplyToken returns a random token for the reply destination of a
+// request
+func newReplyToken() (string, error) {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token[:]), nil
+}
+
+// ClientOption configures the connection of a HyenaClient
+type ClientOption func(hello *Hello)
+
+// ClientName names the client in the logs of hyenad
+func ClientName(name string) ClientOption {
+	return func(hello *Hello) {
+		hello.Name = name
+	}
+}
+
+// FrameSizeLimit sets the size of the largest frame the client accepts, and
+// sends, from MinFrameSize to MaxFrameSize
+func FrameSizeLimit(size int) ClientOption {
+	return func(hello *Hello) {
+		hello.MaxFrameSize = size
+	}
+}
+
+// RequestCapabilities asks hyenad for optional protocol features, Welcome
+// tells the ones granted
+func RequestCapabilities(capabilities Capabilities) ClientOption {
+	return func(hello *Hello) {
+		hello.Capabilities |= capabilities
+	}
+}
+
+// NewHyenaClient connects to hyenad as process pid, it fails when hyenad
+// rejects the handshake
+func NewHyenaClient(pid uint32, listener StreamListener, opts ...ClientOption) (HyenaClient, error) {
 	conn, err := net.Dial("tcp", PROCESS_ADDRESS)
 	if err != nil {
-		return res, err
+		return HyenaClient{}, err
+	}
+	return newHyenaClient(conn, pid, listener, opts...)
+}
+
+func newHyenaClient(conn net.Conn, pid uint32, listener StreamListener, opts ...ClientOption) (HyenaClient, error) {
+	InitFrameBuffers()
+	res := HyenaClient{nextId: new(uint64)}
+	hello := Hello{Pid: pid}
+	for _, opt := range opts {
+		opt(&hello)
 	}
-	res.address = Address{0, pid}
 	res.conn = conn
+	res.reader = bufio.NewReader(conn)
 	res.send = make(chan *Frame)
 	res.handlerChan = make(chan inboundStream, 256)
 	res.listener = listener
-	pidBuf := [4]byte{0, 0, 0, 0}
-	binary.BigEndian.PutUint32(pidBuf[0:4], pid)
-	n, err := res.conn.Write(pidBuf[0:4])
-	if err != nil || n != 4 {
-		return res, err
+	res.replies = &pendingReplies{waiting: make(map[MsgId]pendingReply), lost: make(chan struct{})}
+	res.aborts = &writeAborts{reasons: make(map[MsgId]error)}
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	err := writeHandshake(conn, hello)
+	if err == nil {
+		var version uint64
+		version, err = readHandshake(res.reader, &res.welcome)
+		if err == nil && version != PROTOCOL_VERSION {
+			err = fmt.Errorf("Unsupported protocol version %v", version)
+		}
 	}
+	if err != nil {
+		conn.Close()
+		return res, fmt.Errorf("Handshake with hyenad: %v", err)
+	}
+	if !res.welcome.Accepted {
+		conn.Close()
+		return res, fmt.Errorf("Hyenad rejected the connection: %v", res.welcome.Reason)
+	}
+	conn.SetDeadline(time.Time{})
+	res.address = Address{res.welcome.Node, pid}
 	go res.write()
 	go res.read()
 	go res.handlers()
 	return res, nil
 }
 
+// Welcome returns the parameters of the connection accepted by hyenad
+func (hc *HyenaClient) Welcome() Welcome {
+	return hc.welcome
+}
+
 type StreamListener interface {
 	OnStream(stream ReadStream)
 }
 
-func (hc *HyenaClient) CreateStream(dest string) *WriteStream {
-	id := atomic.AddUint64(&hc.nextId, 1)
-	s := NewWriteStream(CreateMid(hc.address.Node, hc.address.Process, id), dest, hc.send)
-	return s
+// CreateStream returns a new stream to dest, or an error if dest does not
+// follow the destination grammar. Writing to the stream fails with an
+// *AbortError once hyenad drops it.
+func (hc *HyenaClient) CreateStream(dest string) (*WriteStream, error) {
+	destination, err := ParseDestination(dest)
+	if err != nil {
+		return nil, err
+	}
+	id := atomic.AddUint64(hc.nextId, 1)
+	s := NewWriteStream(CreateMid(hc.address.Node, hc.address.Process, id), destination, hc.send)
+	s.maxFrameSize = hc.welcome.MaxFrameSize
+	if s.frameSize > s.maxFrameSize {
+		s.frameSize = s.maxFrameSize
+	}
+	s.aborts = hc.aborts
+	hc.aborts.open(s.Id)
+	return s, nil
 }
 
-func (hc *HyenaClient) StreamTo(dest string, reader io.Reader) {
-	s := hc.CreateStream(dest)
-	io.Copy(s, reader)
+// StreamTo sends the contents of reader to dest, the stream is aborted when
+// reading fails. It returns an *AbortError when hyenad drops the stream.
+func (hc *HyenaClient) StreamTo(dest string, reader io.Reader) error {
+	s, err := hc.CreateStream(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(s, reader)
+	if err != nil {
+		s.Abort(err)
+		return err
+	}
+	return s.Close()
+}
+
+// RequestError is returned by Request when the request could not be
+// delivered, Reason is the error reported by hyenad
+type RequestError struct {
+	Destination string
+	Reason      string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Request to %v failed: %v", e.Destination, e.Reason)
+}
+
+// Request sends body to dest and returns the stream replied with
+// ReadStream.Reply. It returns ctx.Err() when ctx is done before the reply
+// arrives, a *RequestError when hyenad can not route the request, and fails at
+// once when the connection to hyenad is lost. The request is aborted when
+// reading body fails.
+// Request can be called from OnStream, the reply must be read to its end as
+// the client stops reading from hyenad while its frames are queued.
+func (hc *HyenaClient) Request(ctx context.Context, dest string, body io.Reader) (ReadStream, error) {
+	s, err := hc.CreateStream(dest)
+	if err != nil {
+		return ReadStream{}, err
+	}
+	token, err := newReplyToken()
+	if err != nil {
+		return ReadStream{}, err
+	}
+	s.SetHeader(HEADER_REPLY_TO, replyDestination(s.Id, token).String())
+	replies := hc.replies.expect(s.Id, token)
+	defer hc.replies.cancel(s.Id, replies)
+	_, err = io.Copy(s, body)
+	if err != nil {
+		s.Abort(err)
+		return ReadStream{}, err
+	}
 	s.Close()
+	reply, err := hc.replies.wait(replies, ctx.Done(), ctx.Err)
+	if err != nil {
+		return reply, err
+	}
+	headers, err := reply.Headers()
+	if err != nil {
+		return reply, err
+	}
+	if reason, failed := headers[HEADER_ERROR]; failed {
+		return reply, &RequestError{Destination: dest, Reason: reason}
+	}
+	return reply, nil
+}
+
+// Control sends body to the routing control operation of hyenad, such as
+// "/dump", and waits up to timeout for its reply
+func (hc *HyenaClient) Control(operation string, body []byte, timeout time.Duration) (ControlReply, error) {
+	reply := ControlReply{}
+	s, err := hc.CreateStream(ROUTING_PREFIX + operation)
+	if err != nil {
+		return reply, err
+	}
+	replies := hc.replies.expect(s.Id, "")
+	defer hc.replies.cancel(s.Id, replies)
+	s.Write(body)
+	s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stream, err := hc.replies.wait(replies, ctx.Done(), func() error {
+		return errors.New("Timeout waiting for hyenad")
+	})
+	if err != nil {
+		return reply, err
+	}
+	data, err := ioutil.ReadAll(&stream)
+	if err != nil {
+		return reply, err
+	}
+	err = json.Unmarshal(data, &reply)
+	if err != nil {
+		return reply, err
+	}
+	if !reply.Ok {
+		return reply, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+// RegisterOption configures a registration made with HyenaClient.Register
+type RegisterOption func(r *registerOptions)
+
+type registerOptions struct {
+	registration Registration
+	timeout      time.Duration
+}
+
+// ShardRange registers the client for the shard range from-to of a Sharded rule
+func ShardRange(from, to string) RegisterOption {
+	return func(r *registerOptions) {
+		r.registration.From = from
+		r.registration.To = to
+	}
+}
+
+// LeaseFor registers the client for ttl only, the registration must be renewed
+// with Renew or registered again before it expires
+func LeaseFor(ttl time.Duration) RegisterOption {
+	return func(r *registerOptions) {
+		r.registration.TTL = ttl
+	}
+}
+
+// RegisterTimeout sets the time to wait for hyenad to accept the registration
+func RegisterTimeout(timeout time.Duration) RegisterOption {
+	return func(r *registerOptions) {
+		r.timeout = timeout
+	}
+}
+
+// Register asks hyenad to add the client as a target of prefix, hyenad removes
+// it when the connection of the client closes. Reserved prefixes and patterns
+// are refused, and the rules declared by the routing of hyenad only accept
+// admins unless they are joinable.
+func (hc *HyenaClient) Register(prefix string, opts ...RegisterOption) error {
+	options := registerOptions{registration: Registration{Prefix: prefix}, timeout: DEFAULT_CONTROL_TIMEOUT}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	body, err := json.Marshal(options.registration)
+	if err != nil {
+		return err
+	}
+	_, err = hc.Control("/register", body, options.timeout)
+	if err != nil {
+		return fmt.Errorf("Registering %v: %v", options.registration, err)
+	}
+	return nil
+}
+
+// Renew renews the leases of the client
+func (hc *HyenaClient) Renew() error {
+	_, err := hc.Control("/renew", nil, DEFAULT_CONTROL_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("Renewing leases: %v", err)
+	}
+	return nil
 }
 
 func (hc *HyenaClient) write() {
 	stop := false
 	for f := range hc.send {
-		buf := f.Buffer()
 		if !stop {
-			size := byte(len(buf))
-			n, err := hc.conn.Write([]byte{size})
-			if err != nil || n != 1 {
-				log.WithError(err).Error("Writing to hyenad client connection")
-				hc.conn.Close()
-				stop = true
-			}
-			n, err = hc.conn.Write(buf)
-			if err != nil || n != len(buf) {
+			err := writeFrame(hc.conn, f)
+			if err != nil {
 				log.WithError(err).Error("Writing to hyenad client connection")
 				hc.conn.Close()
 				stop = true
 			}
-			frameBuffers.Return(buf)
+			f.Release()
 		} else {
-			frameBuffers.Return(buf)
+			f.Release()
 			log.WithField("Frame", f).Warn("Dropping frame, connection down")
 		}
 	}
@@ -112,27 +498,12 @@ func (hc *HyenaClient) handlers() {
 }
 
 func (hc *HyenaClient) read() {
-	size := [1]byte{0}
 	streams := make(map[MsgId]inboundStream)
 	var stream inboundStream
 	var ok bool
 	for {
-		n, err := hc.conn.Read(size[0:1])
-		if err != nil || n != 1 {
-			log.WithError(err).WithField("Wrote", n).Error("Reading frame size")
-			break
-		}
-		buf := frameBuffers.Get()
-		buf = buf[0:size[0]]
-		n, err = io.ReadFull(hc.conn, buf)
-		if err != nil || n != len(buf) {
-			log.WithError(err).WithField("Read", n).WithField("Expected", len(buf)).Error("Reading frame ")
-			frameBuffers.Return(buf)
-			break
-		}
-		f, err := ReadFrame(buf)
+		f, err := readFrame(hc.reader, hc.welcome.MaxFrameSize)
 		if err != nil {
-			frameBuffers.Return(buf)
 			log.WithError(err).Error("Reading frame")
 			break
 		}
@@ -141,17 +512,22 @@ func (hc *HyenaClient) read() {
 		}
 		if f.Flags.Is(FIRSTFRAME) {
 			stream = inboundStream{frames: make(chan *Frame, 2)}
-			stream.frames <- &f
+			stream.frames <- f
 			stream.stream, err = NewReadStream(stream.frames)
 			if err != nil {
-				frameBuffers.Return(buf)
 				log.WithField("Frame", f.String()).WithError(err).Error("Creating read stream")
+				f.Release()
 				break
 			}
+			stream.stream.client = hc
 			if debug {
 				log.WithField("Stream", stream.stream).WithField("Listener", hc.listener).Debug("Sending stream to listener")
 			}
-			hc.handlerChan <- stream
+			// Replies are delivered here, a handler waiting for one must not
+			// hold it up
+			if !hc.replies.deliver(stream.stream) {
+				hc.handlerChan <- stream
+			}
 			if !f.Flags.Is(LASTFRAME) {
 				streams[f.Id] = stream
 			} else {
@@ -159,15 +535,20 @@ func (hc *HyenaClient) read() {
 			}
 		} else {
 			stream, ok = streams[f.Id]
+			if !ok && f.Flags.Is(ABORT) && hc.aborts.abort(f.Id, &AbortError{Reason: string(f.Contents())}) {
+				// hyenad dropped a stream of the client
+				f.Release()
+				continue
+			}
 			if !ok {
-				frameBuffers.Return(buf)
 				log.WithField("Frame", f.String()).Error("No stream found")
+				f.Release()
 				continue
 			}
 			if debug {
 				log.WithField("Stream", stream.stream).WithField("Listener", hc.listener).Debug("Sending frame to existing stream")
 			}
-			stream.frames <- &f
+			stream.frames <- f
 		}
 		if f.Flags.Is(LASTFRAME) && !f.Flags.Is(FIRSTFRAME) {
 			close(stream.frames)
@@ -175,4 +556,13 @@ func (hc *HyenaClient) read() {
 		}
 	}
 	hc.conn.Close()
+	hc.replies.connectionLost()
+	// Streams cut by the connection loss are aborted for their readers
+	for id, open := range streams {
+		abort, err := NewFrame(FrameHeader{Id: id, Flags: LASTFRAME | ABORT}, []byte("Connection to hyenad lost"))
+		if err == nil {
+			open.frames <- &abort
+		}
+		close(open.frames)
+	}
 }
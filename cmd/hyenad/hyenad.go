@@ -17,6 +17,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/neuneu2k/hyenad"
@@ -43,44 +44,138 @@ func run(c *cli.Context) {
 			f.Close()
 		}()
 	}
-	config := Config{}
-	configFile, err := os.Open(c.String("config"))
+	configPath := c.String("config")
+	config, err := loadConfig(configPath)
 	if err != nil {
 		panic(err)
 	}
-	err = json.NewDecoder(configFile).Decode(&config)
+	err = checkConfig(config)
 	if err != nil {
 		panic(err)
 	}
 	log.WithField("Config", config).Debug("Config file loaded")
-	factory, err := hyenad.NewLocalConnectionFactory()
+	var node uint32
+	var opts []hyenad.RouterOption
+	if config.Node != nil {
+		node = *config.Node
+		opts = append(opts, hyenad.LocalNode(node))
+	}
+	factory, err := hyenad.NewLocalConnectionFactory(node)
 	if err != nil {
 		panic(err)
 	}
 	routing := hyenad.NewRoutingTree()
 	routing.Apply(config.Routing)
-	router := hyenad.NewRouter(routing, factory)
+	router := hyenad.NewRouter(routing, factory, opts...)
+	control := hyenad.NewRoutingControl(routing, config.Admins, router.Recv())
+	control.SetRouter(router)
+	control.AllowJoin(config.Joinable)
+	factory.Register(hyenad.DAEMON_PID, control)
+	factory.OnClose(func(pid uint32) {
+		control.Unregister(hyenad.Address{Node: node, Process: pid})
+	})
 	log.Info("Started Router")
-	closeChan := make(chan os.Signal, 1)
-	signal.Notify(closeChan, os.Interrupt)
-	signal.Notify(closeChan, syscall.SIGTERM)
-	<-closeChan
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	signal.Notify(signals, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGHUP)
+	for s := range signals {
+		if s != syscall.SIGHUP {
+			break
+		}
+		reload(configPath, routing)
+	}
 	router.Stop()
 	log.Info("Stopped Router")
 }
 
+// loadConfig reads the config file at path, unknown fields are errors so a
+// misspelled section is not silently ignored
+func loadConfig(path string) (Config, error) {
+	config := Config{}
+	configFile, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer configFile.Close()
+	decoder := json.NewDecoder(configFile)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	return config, err
+}
+
+// checkConfig logs the warnings of the routing validation and returns its errors
+func checkConfig(config Config) error {
+	validation := config.Routing.Validate()
+	for _, warning := range validation.Warnings {
+		log.WithField("Warning", warning).Warn("Suspicious routing configuration")
+	}
+	return validation.Err()
+}
+
+func validate(c *cli.Context) {
+	config, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", c.String("config"), err)
+		os.Exit(1)
+	}
+	validation := config.Routing.Validate()
+	for _, e := range validation.Errors {
+		fmt.Fprintf(os.Stderr, "error: %v\n", e)
+	}
+	for _, w := range validation.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", w)
+	}
+	if len(validation.Errors) > 0 || (c.Bool("strict") && len(validation.Warnings) > 0) {
+		os.Exit(1)
+	}
+}
+
+// reload applies the routing of the config file at path to the live routing
+// tree, streams in flight keep their current connection.
+func reload(path string, routing *hyenad.RoutingTree) {
+	config, err := loadConfig(path)
+	if err != nil {
+		log.WithField("Config", path).WithError(err).Error("Reloading config file, keeping current routing")
+		return
+	}
+	err = checkConfig(config)
+	if err != nil {
+		log.WithField("Config", path).WithError(err).Error("Reloading config file, keeping current routing")
+		return
+	}
+	update := routing.Replace(config.Routing)
+	log.WithField("Deleted", len(update.Deletes)).WithField("Services", len(update.Services)).WithField("Shards", len(update.Shards)).Info("Reloaded routing")
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "router"
 	app.Usage = "Hyena Net Routing Daemon"
 	app.Action = run
 	app.Version = "0.1.0"
-	app.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:  "config, c",
-			Value: "hyenad.json",
-			Usage: "HyenaD configuration",
+	configFlag := cli.StringFlag{
+		Name:  "config, c",
+		Value: "hyenad.json",
+		Usage: "HyenaD configuration",
+	}
+	app.Commands = []cli.Command{
+		routesCommand,
+		{
+			Name:   "validate",
+			Usage:  "Check the configuration without starting the daemon",
+			Action: validate,
+			Flags: []cli.Flag{
+				configFlag,
+				cli.BoolFlag{
+					Name:  "strict",
+					Usage: "Fail on warnings too",
+				},
+			},
 		},
+	}
+	app.Flags = []cli.Flag{
+		configFlag,
 		cli.BoolFlag{
 			Name:  "profile",
 			Usage: "Save profiling data",
@@ -90,5 +185,12 @@ func main() {
 }
 
 type Config struct {
+	// Node is the id of the local node, targets on it are preferred to remote ones
+	Node    *uint32
 	Routing hyenad.RoutingTreeUpdate
+	// Admins are the processes allowed to update routing through hyenad.ROUTING_PREFIX
+	Admins hyenad.Addresses
+	// Joinable are the rules of Routing any process may register on, only
+	// admins may register on the others
+	Joinable []string
 }
@@ -0,0 +1,181 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/neuneu2k/hyenad"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// discardListener drops the streams sent to the control client
+type discardListener struct{}
+
+func (discardListener) OnStream(stream hyenad.ReadStream) {
+	io.Copy(ioutil.Discard, &stream)
+}
+
+func controlRequest(c *cli.Context, operation string, body []byte) (hyenad.ControlReply, error) {
+	client, err := hyenad.NewHyenaClient(uint32(c.Int("pid")), discardListener{}, hyenad.ClientName("hyenad routes"))
+	if err != nil {
+		return hyenad.ControlReply{}, err
+	}
+	return client.Control(operation, body, c.Duration("timeout"))
+}
+
+// printResult pretty prints the result of a control request
+func printResult(reply hyenad.ControlReply) {
+	out := bytes.Buffer{}
+	err := json.Indent(&out, reply.Result, "", "  ")
+	if err != nil {
+		out.Reset()
+		out.Write(reply.Result)
+	}
+	out.WriteString("\n")
+	out.WriteTo(os.Stdout)
+}
+
+func dumpRoutes(c *cli.Context) {
+	reply, err := controlRequest(c, "/dump", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Dumping routes: %v\n", err)
+		os.Exit(1)
+	}
+	printResult(reply)
+}
+
+func listLeases(c *cli.Context) {
+	reply, err := controlRequest(c, "/leases", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Listing leases: %v\n", err)
+		os.Exit(1)
+	}
+	printResult(reply)
+}
+
+func reshard(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: hyenad routes reshard <reshard.json>")
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Resharding: %v\n", err)
+		os.Exit(1)
+	}
+	reply, err := controlRequest(c, "/reshard", body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Resharding: %v\n", err)
+		os.Exit(1)
+	}
+	printResult(reply)
+}
+
+func listStreams(c *cli.Context) {
+	reply, err := controlRequest(c, "/streams", []byte(c.Args().First()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Listing streams: %v\n", err)
+		os.Exit(1)
+	}
+	printResult(reply)
+}
+
+func showMetrics(c *cli.Context) {
+	reply, err := controlRequest(c, "/metrics", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading metrics: %v\n", err)
+		os.Exit(1)
+	}
+	printResult(reply)
+}
+
+func explainRoute(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: hyenad routes explain <destination>")
+		os.Exit(1)
+	}
+	reply, err := controlRequest(c, "/explain", []byte(c.Args().First()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Explaining route: %v\n", err)
+		os.Exit(1)
+	}
+	printResult(reply)
+}
+
+var controlFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "pid, p",
+		Value: 1000,
+		Usage: "ProcessId used to connect to hyenad",
+	},
+	cli.DurationFlag{
+		Name:  "timeout",
+		Value: 5 * time.Second,
+		Usage: "Time to wait for the answer of hyenad",
+	},
+}
+
+var routesCommand = cli.Command{
+	Name:  "routes",
+	Usage: "Inspect the routing of a running hyenad",
+	Subcommands: []cli.Command{
+		{
+			Name:   "dump",
+			Usage:  "Print the live routing table",
+			Action: dumpRoutes,
+			Flags:  controlFlags,
+		},
+		{
+			Name:      "explain",
+			Usage:     "Show how a destination is routed",
+			ArgsUsage: "<destination>",
+			Action:    explainRoute,
+			Flags:     controlFlags,
+		},
+		{
+			Name:      "reshard",
+			Usage:     "Split, merge or move shard ranges, new streams go to the new owners",
+			ArgsUsage: "<reshard.json>",
+			Action:    reshard,
+			Flags:     controlFlags,
+		},
+		{
+			Name:      "streams",
+			Usage:     "List the streams in flight per rule and target, to follow a handover",
+			ArgsUsage: "[prefix]",
+			Action:    listStreams,
+			Flags:     controlFlags,
+		},
+		{
+			Name:   "leases",
+			Usage:  "List the leased targets and the number of expired leases",
+			Action: listLeases,
+			Flags:  controlFlags,
+		},
+		{
+			Name:   "metrics",
+			Usage:  "Print the router metrics and the circuits of its targets",
+			Action: showMetrics,
+			Flags:  controlFlags,
+		},
+	},
+}
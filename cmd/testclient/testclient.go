@@ -30,7 +30,7 @@ import (
 
 func runOnce(pid uint32) {
 	listener := newListener("", 1)
-	client, err := hyenad.NewHyenaClient(pid, listener)
+	client, err := hyenad.NewHyenaClient(pid, listener, hyenad.ClientName("testclient"))
 	if err != nil {
 		panic(err)
 	}
@@ -44,7 +44,10 @@ func runOnce(pid uint32) {
 	message := fmt.Sprintf("Message from Process %v", pid)
 	reader := bytes.NewReader([]byte(message))
 	log.Info("Sending message")
-	client.StreamTo(dest, reader)
+	err = client.StreamTo(dest, reader)
+	if err != nil {
+		panic(err)
+	}
 	log.Info("Message sent")
 	listener.wait.Wait()
 	log.Info("Done")
@@ -68,7 +71,7 @@ func runSend(iterations int, profile bool) {
 		}()
 	}
 	listener := newListener("", 0)
-	client, err := hyenad.NewHyenaClient(1, listener)
+	client, err := hyenad.NewHyenaClient(1, listener, hyenad.ClientName("testclient"))
 	if err != nil {
 		panic(err)
 	}
@@ -83,7 +86,10 @@ func runSend(iterations int, profile bool) {
 			log.WithField("MessageLength", len(message)).Info("Message created")
 		}
 		reader := bytes.NewReader([]byte(message))
-		client.StreamTo(dest, reader)
+		err = client.StreamTo(dest, reader)
+		if err != nil {
+			panic(err)
+		}
 		if i%5000 == 0 {
 			log.WithField("Messages", i).Info("Sending Messages")
 		}
@@ -112,7 +118,7 @@ func runRecv(iterations int, profile bool) {
 		}()
 	}
 	listener := newListener("", iterations)
-	_, err := hyenad.NewHyenaClient(2, listener)
+	_, err := hyenad.NewHyenaClient(2, listener, hyenad.ClientName("testclient"))
 	if err != nil {
 		panic(err)
 	}
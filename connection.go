@@ -21,3 +21,9 @@ type Connection interface {
 	Ok() bool
 	Close() error
 }
+
+// throttler is implemented by the connections that can stop reading from
+// their process while a connection it writes to is congested
+type throttler interface {
+	throttle(congested Connection)
+}
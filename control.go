@@ -0,0 +1,398 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ROUTING_PREFIX is the destination prefix owned by hyenad for routing table
+// management, every stream sent to it is answered on ReplyDestination with a
+// ControlReply. The operation is selected by the rest of the destination:
+// h:/routing and h:/routing/update apply the RoutingTreeUpdate in the body,
+// h:/routing/dump returns the RoutingTree Snapshot, h:/routing/explain returns
+// the Explanation of the destination in the body, h:/routing/register adds the
+// sender as a target of the Registration in the body until its connection
+// closes or its lease expires, h:/routing/renew renews the leases of the
+// sender and h:/routing/leases returns the LeaseStatus. h:/routing/reshard
+// applies the Reshard in the body and returns the Handover, h:/routing/streams
+// returns the streams in flight on the rules starting with the body and
+// h:/routing/metrics returns the RouterStatus.
+const ROUTING_PREFIX = "h:/routing"
+
+// LEASE_CHECK_INTERVAL is the period of the lease expiry check
+const LEASE_CHECK_INTERVAL = time.Second
+
+// LeaseStatus is the result of h:/routing/leases
+type LeaseStatus struct {
+	Leases []Lease `json:"leases"`
+	// Expired is the number of leases expired since hyenad started
+	Expired uint64 `json:"expired"`
+}
+
+// ControlReply is the body of the reply to a control stream
+type ControlReply struct {
+	Ok     bool            `json:"ok"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// RoutingControl is the in-process connection serving ROUTING_PREFIX
+type RoutingControl struct {
+	routing *RoutingTree
+	admins  Addresses
+	send    chan *Frame
+	output  chan<- *Frame
+	closed  uint32
+	// registrations of every sender, removed by Unregister
+	registrations map[Address]map[Registration]bool
+	lock          sync.Mutex
+	expired       uint64
+	stop          chan struct{}
+	// openStreams reports the streams in flight, set by SetRouter
+	openStreams func(prefix string) []StreamCount
+	// status reports the metrics and circuits of the router, set by SetRouter
+	status func() RouterStatus
+	// joinable are the declared rules processes other than admins may
+	// register on, set by AllowJoin
+	joinable map[string]bool
+}
+
+// NewRoutingControl reserves ROUTING_PREFIX in routing for hyenad and returns
+// the connection serving it. Only admins may update the routing, replies are
+// sent to output, usually the Recv channel of the router.
+func NewRoutingControl(routing *RoutingTree, admins Addresses, output chan<- *Frame) *RoutingControl {
+	res := RoutingControl{}
+	res.routing = routing
+	res.admins = admins
+	res.output = output
+	res.send = make(chan *Frame, 64)
+	res.registrations = make(map[Address]map[Registration]bool)
+	res.stop = make(chan struct{})
+	routing.Reserve(ROUTING_PREFIX, Simple{Targets: Addresses{DAEMON_ADDRESS}})
+	go res.run()
+	go res.expireLeases()
+	return &res
+}
+
+func (c *RoutingControl) run() {
+	streams := make(map[MsgId]chan *Frame)
+	for f := range c.send {
+		if f.Flags.Is(FIRSTFRAME) {
+			frames := make(chan *Frame, 16)
+			frames <- f
+			go c.handle(frames)
+			if f.Flags.Is(LASTFRAME) {
+				close(frames)
+			} else {
+				streams[f.Id] = frames
+			}
+			continue
+		}
+		frames, ok := streams[f.Id]
+		if !ok {
+			f.Release()
+			log.WithField("Frame", f.String()).Error("No control stream found")
+			continue
+		}
+		frames <- f
+		if f.Flags.Is(LASTFRAME) {
+			close(frames)
+			delete(streams, f.Id)
+		}
+	}
+}
+
+func (c *RoutingControl) handle(frames chan *Frame) {
+	stream, err := NewReadStream(frames)
+	if err != nil {
+		log.WithError(err).Error("Creating control stream")
+		return
+	}
+	body, err := ioutil.ReadAll(&stream)
+	if err != nil {
+		c.reply(stream.MessageId(), nil, err)
+		return
+	}
+	nid, pid, _ := stream.id.Split()
+	sender := Address{nid, pid}
+	operation := strings.TrimPrefix(stream.Destination(), ROUTING_PREFIX)
+	var result interface{}
+	switch operation {
+	case "", "/update":
+		{
+			err = c.update(sender, body)
+		}
+	case "/register":
+		{
+			err = c.register(sender, body)
+		}
+	case "/renew":
+		{
+			result = c.Renew(sender)
+		}
+	case "/leases":
+		{
+			result = LeaseStatus{Leases: c.routing.Leases(), Expired: atomic.LoadUint64(&c.expired)}
+		}
+	case "/reshard":
+		{
+			result, err = c.reshard(sender, body)
+		}
+	case "/streams":
+		{
+			result = c.streams(string(body))
+		}
+	case "/metrics":
+		{
+			result, err = c.routerStatus()
+		}
+	case "/dump":
+		{
+			result = c.routing.Snapshot()
+		}
+	case "/explain":
+		{
+			result = c.routing.Explain(string(body))
+		}
+	default:
+		{
+			err = fmt.Errorf("Unknown routing operation %q", operation)
+		}
+	}
+	if err != nil {
+		log.WithField("Sender", sender).WithField("Operation", operation).WithError(err).Warn("Routing control request failed")
+	}
+	c.reply(stream.MessageId(), result, err)
+}
+
+func (c *RoutingControl) update(sender Address, body []byte) error {
+	if !c.admins.contains(sender) {
+		return fmt.Errorf("Process %v.%v is not allowed to update routing", sender.Node, sender.Process)
+	}
+	update := RoutingTreeUpdate{}
+	err := json.Unmarshal(body, &update)
+	if err != nil {
+		return fmt.Errorf("Invalid routing update: %v", err)
+	}
+	validation := update.Validate()
+	if err := validation.Err(); err != nil {
+		return err
+	}
+	for _, warning := range validation.Warnings {
+		log.WithField("Sender", sender).WithField("Warning", warning).Warn("Suspicious routing update")
+	}
+	if reserved := c.routing.Reserved(update); len(reserved) > 0 {
+		return fmt.Errorf("Reserved prefixes can not be updated: %v", reserved)
+	}
+	c.routing.Apply(update)
+	log.WithField("Sender", sender).WithField("Deleted", len(update.Deletes)).WithField("Services", len(update.Services)).WithField("Shards", len(update.Shards)).Info("Applied routing update")
+	return nil
+}
+
+func (c *RoutingControl) reshard(sender Address, body []byte) (interface{}, error) {
+	if !c.admins.contains(sender) {
+		return nil, fmt.Errorf("Process %v.%v is not allowed to update routing", sender.Node, sender.Process)
+	}
+	reshard := Reshard{}
+	err := json.Unmarshal(body, &reshard)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid reshard: %v", err)
+	}
+	handover, err := c.routing.Reshard(reshard)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]bool)
+	for _, shard := range handover.Previous {
+		previous[reshard.Prefix+"["+shard.From+"]"] = true
+	}
+	for _, count := range c.streams(reshard.Prefix) {
+		if previous[count.Rule] {
+			handover.Streams = append(handover.Streams, count)
+		}
+	}
+	log.WithField("Sender", sender).WithField("Prefix", reshard.Prefix).WithField("From", reshard.From).WithField("To", reshard.To).WithField("Ranges", len(reshard.Ranges)).WithField("InFlight", len(handover.Streams)).Info("Resharded rule")
+	return handover, nil
+}
+
+// RouterStatus is the result of h:/routing/metrics
+type RouterStatus struct {
+	Metrics  RouterMetrics `json:"metrics"`
+	Circuits []Circuit     `json:"circuits"`
+}
+
+// SetRouter lets the control report the streams in flight, the metrics and
+// the circuits of router
+func (c *RoutingControl) SetRouter(router Router) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.openStreams = router.OpenStreams
+	c.status = func() RouterStatus {
+		return RouterStatus{Metrics: router.Metrics(), Circuits: router.Circuits()}
+	}
+}
+
+func (c *RoutingControl) routerStatus() (RouterStatus, error) {
+	c.lock.Lock()
+	status := c.status
+	c.lock.Unlock()
+	if status == nil {
+		return RouterStatus{}, errors.New("No router to report on")
+	}
+	return status(), nil
+}
+
+func (c *RoutingControl) streams(prefix string) []StreamCount {
+	c.lock.Lock()
+	openStreams := c.openStreams
+	c.lock.Unlock()
+	if openStreams == nil {
+		return nil
+	}
+	return openStreams(prefix)
+}
+
+// AllowJoin lets every process register on the declared rules of prefixes,
+// the other declared rules only accept admins
+func (c *RoutingControl) AllowJoin(prefixes []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.joinable = make(map[string]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		c.joinable[prefix] = true
+	}
+}
+
+func (c *RoutingControl) register(sender Address, body []byte) error {
+	registration := Registration{}
+	err := json.Unmarshal(body, &registration)
+	if err != nil {
+		return fmt.Errorf("Invalid registration: %v", err)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.admins.contains(sender) && !c.joinable[registration.Prefix] && c.routing.Declared(registration.Prefix) {
+		return fmt.Errorf("Rule %v is declared by the routing, only admins can register on it", registration.Prefix)
+	}
+	err = c.routing.AddTarget(registration, sender)
+	if err != nil {
+		return err
+	}
+	if c.registrations[sender] == nil {
+		c.registrations[sender] = make(map[Registration]bool)
+	}
+	c.registrations[sender][registration.target()] = true
+	log.WithField("Sender", sender).WithField("Registration", registration.String()).WithField("TTL", registration.TTL).Info("Registered target")
+	return nil
+}
+
+// Renew renews the leases of address, it serves h:/routing/renew: hyenad does
+// not renew leases by itself, clients must call HyenaClient.Renew within their
+// TTL. It returns the number of leases renewed.
+func (c *RoutingControl) Renew(address Address) int {
+	return c.routing.Renew(address)
+}
+
+func (c *RoutingControl) expireLeases() {
+	ticker := time.NewTicker(LEASE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			{
+				c.expire(now)
+			}
+		case <-c.stop:
+			{
+				return
+			}
+		}
+	}
+}
+
+func (c *RoutingControl) expire(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, lease := range c.routing.Expire(now) {
+		delete(c.registrations[lease.Address], lease.Registration.target())
+		if len(c.registrations[lease.Address]) == 0 {
+			delete(c.registrations, lease.Address)
+		}
+		atomic.AddUint64(&c.expired, 1)
+		log.WithField("Address", lease.Address).WithField("Registration", lease.Registration.String()).WithField("Expired", lease.Expires).Warn("Lease expired, removed target")
+	}
+}
+
+// Unregister removes address from the targets it registered, it is called
+// when the connection of address closes
+func (c *RoutingControl) Unregister(address Address) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for registration := range c.registrations[address] {
+		c.routing.RemoveTarget(registration, address)
+		log.WithField("Address", address).WithField("Registration", registration.String()).Info("Unregistered target")
+	}
+	delete(c.registrations, address)
+}
+
+func (c *RoutingControl) reply(id MsgId, result interface{}, err error) {
+	reply := ControlReply{}
+	if err == nil && result != nil {
+		reply.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		reply = ControlReply{Error: err.Error()}
+	} else {
+		reply.Ok = true
+	}
+	body, _ := json.Marshal(reply)
+	s := NewWriteStream(newDaemonMsgId(), ReplyDestination(id), c.output)
+	s.Write(body)
+	s.Close()
+}
+
+func (c *RoutingControl) Queue() int {
+	return len(c.send)
+}
+
+func (c *RoutingControl) Send(frame *Frame) error {
+	if !c.Ok() {
+		frame.Release()
+		return errors.New("Routing control closed")
+	}
+	c.send <- frame
+	return nil
+}
+
+func (c *RoutingControl) Ok() bool {
+	return atomic.LoadUint32(&c.closed) == 0
+}
+
+func (c *RoutingControl) Close() error {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		close(c.stop)
+	}
+	return nil
+}
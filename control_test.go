@@ -0,0 +1,231 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// controlRequest streams body to dest on control and returns the decoded reply
+func controlRequest(control *RoutingControl, replies chan *Frame, id MsgId, dest string, body string, t *testing.T) ControlReply {
+	frames := make(chan *Frame, 16)
+	stream := NewWriteStream(id, MustParseDestination(dest), frames)
+	stream.Write([]byte(body))
+	stream.Close()
+	close(frames)
+	for f := range frames {
+		control.Send(f)
+	}
+	frames = make(chan *Frame, 16)
+	for {
+		f := <-replies
+		frames <- f
+		if f.Flags.Is(LASTFRAME) {
+			break
+		}
+	}
+	close(frames)
+	readStream, err := NewReadStream(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readStream.Destination() != ReplyDestination(id).String() {
+		t.Errorf("Expected reply to %v, got %v", ReplyDestination(id), readStream.Destination())
+	}
+	data, _ := ioutil.ReadAll(&readStream)
+	reply := ControlReply{}
+	err = json.Unmarshal(data, &reply)
+	if err != nil {
+		t.Fatalf("Invalid reply %q: %v", data, err)
+	}
+	return reply
+}
+
+func TestRoutingControl(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	replies := make(chan *Frame, 16)
+	control := NewRoutingControl(routing, Addresses{Address{0, 5}}, replies)
+	check(ROUTING_PREFIX+"/update", Addresses{DAEMON_ADDRESS}, routing, t)
+	update := `{"services":{"s:/test":{"targets":[0.1]}}}`
+	reply := controlRequest(control, replies, CreateMid(0, 6, 1), ROUTING_PREFIX, update, t)
+	if reply.Ok {
+		t.Error("Expected update from a non admin process to be rejected")
+	}
+	check("s:/test/toto", Addresses{}, routing, t)
+	reply = controlRequest(control, replies, CreateMid(0, 5, 1), ROUTING_PREFIX, update, t)
+	if !reply.Ok {
+		t.Errorf("Expected update to be applied, got %v", reply.Error)
+	}
+	check("s:/test/toto", Addresses{Address{0, 1}}, routing, t)
+	reply = controlRequest(control, replies, CreateMid(0, 5, 2), ROUTING_PREFIX, `{"delete":["h:/routing"]}`, t)
+	if reply.Ok {
+		t.Error("Expected update of a reserved prefix to be rejected")
+	}
+	reply = controlRequest(control, replies, CreateMid(0, 5, 3), ROUTING_PREFIX, `{"services":`, t)
+	if reply.Ok {
+		t.Error("Expected invalid JSON to be rejected")
+	}
+	check(ROUTING_PREFIX, Addresses{DAEMON_ADDRESS}, routing, t)
+}
+
+func TestRoutingControlDump(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/test", Simple{Targets: Addresses{Address{0, 1}}, Policy: ROUND_ROBIN})
+	replies := make(chan *Frame, 16)
+	control := NewRoutingControl(routing, Addresses{}, replies)
+	reply := controlRequest(control, replies, CreateMid(0, 6, 1), ROUTING_PREFIX+"/dump", "", t)
+	if !reply.Ok {
+		t.Fatalf("Expected dump to succeed, got %v", reply.Error)
+	}
+	snapshot := RoutingTreeUpdate{}
+	err := json.Unmarshal(reply.Result, &snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Services) != 2 || snapshot.Services["s:/test"].Policy != ROUND_ROBIN {
+		t.Errorf("Unexpected snapshot %v", snapshot)
+	}
+}
+
+func TestRoutingControlMetrics(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	replies := make(chan *Frame, 16)
+	control := NewRoutingControl(routing, Addresses{}, replies)
+	metrics := ROUTING_PREFIX + "/metrics"
+	if reply := controlRequest(control, replies, CreateMid(0, 6, 1), metrics, "", t); reply.Ok {
+		t.Error("Expected metrics without a router to be rejected")
+	}
+	router := NewRouter(staticRouting{}, countingConnectionFactory{})
+	sendStream(router, CreateMid(0, 0, 1), "s:/nowhere", []byte("Lorel Ipsum"))
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	control.SetRouter(router)
+	reply := controlRequest(control, replies, CreateMid(0, 6, 2), metrics, "", t)
+	if !reply.Ok {
+		t.Fatalf("Expected metrics, got %v", reply.Error)
+	}
+	status := RouterStatus{}
+	if err := json.Unmarshal(reply.Result, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Metrics.DroppedStreams != 1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestRoutingControlRegister(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/static", Simple{Targets: Addresses{Address{0, 1}}})
+	replies := make(chan *Frame, 16)
+	control := NewRoutingControl(routing, Addresses{}, replies)
+	control.AllowJoin([]string{"s:/static"})
+	register := ROUTING_PREFIX + "/register"
+	for i, request := range []struct {
+		pid  uint32
+		body string
+	}{
+		{5, `{"prefix":"s:/static"}`},
+		{5, `{"prefix":"s:/users/","from":"a","to":"m"}`},
+		{6, `{"prefix":"s:/users/","from":"n","to":"z"}`},
+		{6, `{"prefix":"s:/module"}`},
+	} {
+		reply := controlRequest(control, replies, CreateMid(0, request.pid, uint64(i)), register, request.body, t)
+		if !reply.Ok {
+			t.Errorf("Expected %v to be registered, got %v", request.body, reply.Error)
+		}
+	}
+	for _, body := range []string{`{"prefix":"h:/routing"}`, `{"prefix":"s:/static","from":"a","to":"m"}`, `{"prefix":"s:/users/","from":"k","to":"p"}`} {
+		reply := controlRequest(control, replies, CreateMid(0, 7, 1), register, body, t)
+		if reply.Ok {
+			t.Errorf("Expected %v to be rejected", body)
+		}
+	}
+	check("s:/static/a", Addresses{Address{0, 1}, Address{0, 5}}, routing, t)
+	check("s:/users/bob", Addresses{Address{0, 5}}, routing, t)
+	check("s:/users/nina", Addresses{Address{0, 6}}, routing, t)
+	check("s:/module/a", Addresses{Address{0, 6}}, routing, t)
+	control.Unregister(Address{0, 6})
+	check("s:/users/bob", Addresses{Address{0, 5}}, routing, t)
+	check("s:/users/nina", Addresses{}, routing, t)
+	check("s:/module/a", Addresses{}, routing, t)
+	control.Unregister(Address{0, 5})
+	check("s:/static/a", Addresses{Address{0, 1}}, routing, t)
+	check("s:/users/bob", Addresses{}, routing, t)
+	if len(routing.Snapshot().Shards) != 0 {
+		t.Errorf("Expected empty sharded rule to be removed, got %v", routing.Snapshot().Shards)
+	}
+}
+
+func TestRoutingControlRegisterRestricted(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/billing", Simple{Targets: Addresses{Address{0, 1}}})
+	replies := make(chan *Frame, 16)
+	control := NewRoutingControl(routing, Addresses{Address{0, 5}}, replies)
+	register := ROUTING_PREFIX + "/register"
+	for i, body := range []string{`{"prefix":"h:/routing/update"}`, `{"prefix":"h:/routing/**"}`, `{"prefix":"h:/**"}`, `{"prefix":"s:/*/x"}`, `{"prefix":"s:/billing"}`} {
+		reply := controlRequest(control, replies, CreateMid(0, 42, uint64(i)), register, body, t)
+		if reply.Ok {
+			t.Errorf("Expected %v to be rejected", body)
+		}
+	}
+	for _, dest := range []string{"h:/routing", "h:/routing/dump", "h:/routing/update"} {
+		check(dest, Addresses{DAEMON_ADDRESS}, routing, t)
+	}
+	check("s:/billing", Addresses{Address{0, 1}}, routing, t)
+	reply := controlRequest(control, replies, CreateMid(0, 5, 1), register, `{"prefix":"s:/billing"}`, t)
+	if !reply.Ok {
+		t.Errorf("Expected an admin to join a declared rule, got %v", reply.Error)
+	}
+	check("s:/billing", Addresses{Address{0, 1}, Address{0, 5}}, routing, t)
+}
+
+func TestRoutingControlLeases(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	replies := make(chan *Frame, 16)
+	control := NewRoutingControl(routing, Addresses{}, replies)
+	defer control.Close()
+	reply := controlRequest(control, replies, CreateMid(0, 5, 1), ROUTING_PREFIX+"/register", `{"prefix":"s:/module","ttl":1000000000}`, t)
+	if !reply.Ok {
+		t.Fatalf("Expected lease to be registered, got %v", reply.Error)
+	}
+	reply = controlRequest(control, replies, CreateMid(0, 5, 2), ROUTING_PREFIX+"/renew", "", t)
+	if !reply.Ok || string(reply.Result) != "1" {
+		t.Errorf("Expected 1 renewed lease, got %v %s", reply.Error, reply.Result)
+	}
+	control.expire(time.Now().Add(time.Minute))
+	check("s:/module/a", Addresses{}, routing, t)
+	reply = controlRequest(control, replies, CreateMid(0, 5, 3), ROUTING_PREFIX+"/leases", "", t)
+	status := LeaseStatus{}
+	err := json.Unmarshal(reply.Result, &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Leases) != 0 || status.Expired != 1 {
+		t.Errorf("Expected one expired lease, got %+v", status)
+	}
+	if len(control.registrations) != 0 {
+		t.Errorf("Expected expired registration to be forgotten, got %v", control.registrations)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Destinations follow the grammar:
+//   destination = scheme ":" path
+//   scheme      = 1*( "a"-"z" )
+//   path        = "/" [ segments ]                  any scheme but x
+//               | nid "/" pid [ "/" [ segments ] ]  scheme x
+//   segments    = segment *( "/" segment )
+//   segment     = *( any printable character but "/" )
+//   nid, pid    = decimal uint32
+// Service destinations such as s:/billing/42 are routed by the routing rules,
+// explicit destinations such as x:0/12/reply go to process pid of node nid.
+// A destination is at most MaxDestinationSize bytes long.
+
+const EXPLICIT_SCHEME = "x"
+
+// MaxDestinationSize is the longest destination a first frame can carry, its
+// length is a single byte of the frame
+const MaxDestinationSize = 255
+
+type Destination struct {
+	Scheme string
+	// Segments of the path, for explicit destinations the ones following pid
+	Segments []string
+	// Address is the target of explicit destinations
+	Address Address
+	raw     string
+}
+
+// ParseDestination parses destination according to the destination grammar
+func ParseDestination(destination string) (Destination, error) {
+	res := Destination{raw: destination}
+	if len(destination) > MaxDestinationSize {
+		return res, fmt.Errorf("Destination %.32q... longer than %v bytes", destination, MaxDestinationSize)
+	}
+	for i, c := range destination {
+		if c < ' ' || c == 0x7f {
+			return res, fmt.Errorf("Destination %q: control character at %v", destination, i)
+		}
+	}
+	colon := strings.IndexByte(destination, ':')
+	if colon < 0 {
+		return res, fmt.Errorf("Destination %q: missing scheme", destination)
+	}
+	res.Scheme = destination[:colon]
+	if res.Scheme == "" {
+		return res, fmt.Errorf("Destination %q: empty scheme", destination)
+	}
+	for i, c := range res.Scheme {
+		if c < 'a' || c > 'z' {
+			return res, fmt.Errorf("Destination %q: invalid character %q in scheme at %v", destination, c, i)
+		}
+	}
+	path := destination[colon+1:]
+	if res.Scheme != EXPLICIT_SCHEME {
+		if !strings.HasPrefix(path, "/") {
+			return res, fmt.Errorf("Destination %q: path must start with /", destination)
+		}
+		if len(path) > 1 {
+			res.Segments = strings.Split(path[1:], "/")
+		}
+		return res, nil
+	}
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 2 {
+		return res, fmt.Errorf("Destination %q: explicit destinations are x:nid/pid", destination)
+	}
+	nid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return res, fmt.Errorf("Destination %q: invalid node id %q", destination, parts[0])
+	}
+	pid, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return res, fmt.Errorf("Destination %q: invalid process id %q", destination, parts[1])
+	}
+	res.Address = Address{uint32(nid), uint32(pid)}
+	if len(parts) == 3 && parts[2] != "" {
+		res.Segments = strings.Split(parts[2], "/")
+	}
+	return res, nil
+}
+
+// MustParseDestination is like ParseDestination but panics on malformed
+// destinations, for destinations known to be valid
+func MustParseDestination(destination string) Destination {
+	res, err := ParseDestination(destination)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// Explicit returns true if the destination names its target address
+func (d Destination) Explicit() bool {
+	return d.Scheme == EXPLICIT_SCHEME
+}
+
+func (d Destination) String() string {
+	return d.raw
+}
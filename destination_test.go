@@ -0,0 +1,79 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDestination(t *testing.T) {
+	for _, test := range []struct {
+		destination string
+		expected    Destination
+	}{
+		{"s:/billing/42", Destination{Scheme: "s", Segments: []string{"billing", "42"}}},
+		{"h:/", Destination{Scheme: "h"}},
+		{"s:/a//b/", Destination{Scheme: "s", Segments: []string{"a", "", "b", ""}}},
+		{"x:3/4", Destination{Scheme: "x", Address: Address{3, 4}}},
+		{"x:3/4/", Destination{Scheme: "x", Address: Address{3, 4}}},
+		{"x:0/4294967295/reply/abc", Destination{Scheme: "x", Segments: []string{"reply", "abc"}, Address: Address{0, DAEMON_PID}}},
+	} {
+		d, err := ParseDestination(test.destination)
+		if err != nil {
+			t.Errorf("%v: %v", test.destination, err)
+			continue
+		}
+		test.expected.raw = test.destination
+		if !reflect.DeepEqual(d, test.expected) {
+			t.Errorf("%v: expected %#v, got %#v", test.destination, test.expected, d)
+		}
+		if d.String() != test.destination {
+			t.Errorf("%v: String returned %v", test.destination, d.String())
+		}
+	}
+	for destination, expected := range map[string]string{
+		"/test":           "missing scheme",
+		":/test":          "empty scheme",
+		"S:/test":         `invalid character 'S' in scheme at 0`,
+		"s:test":          "path must start with /",
+		"s:/te\nst":       "control character at 5",
+		"x:3":             "explicit destinations are x:nid/pid",
+		"x:a/4":           `invalid node id "a"`,
+		"x:3/99999999999": `invalid process id "99999999999"`,
+		"s:/" + strings.Repeat("a", MaxDestinationSize): "longer than",
+	} {
+		_, err := ParseDestination(destination)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error containing %q, got %v", destination, expected, err)
+		}
+	}
+}
+
+func TestRouterMalformedDestination(t *testing.T) {
+	InitFrameBuffers()
+	router := NewRouter(staticRouting{Addresses: Addresses{Address{0, 1}}}, countingConnectionFactory{})
+	f, err := NewFrame(FrameHeader{Id: CreateMid(0, 0, 1), Flags: FIRSTFRAME | LASTFRAME, Dest: "billing"}, []byte("Lorel Ipsum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.route(&streams{dropped: make(map[MsgId]bool)}, &f)
+	if m := router.Metrics(); m.DroppedStreams != 1 {
+		t.Errorf("Expected malformed destination to be dropped, got %+v", m)
+	}
+	router.Stop()
+}
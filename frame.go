@@ -16,8 +16,12 @@ limitations under the License.
 package hyenad
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
 )
 
 type Flags byte
@@ -29,11 +33,25 @@ func (f Flags) Is(flag Flags) bool {
 const (
 	FIRSTFRAME Flags = 1
 	LASTFRAME  Flags = 2
+	// HEADERS marks a first frame whose contents start with a header block
+	HEADERS Flags = 4
+	// ABORT marks a last frame ending a stream that failed, its contents are
+	// the reason of the failure instead of contents of the stream
+	ABORT Flags = 8
 )
 
 const FrameHeaderSize = 16 + 8 + 1
 
-const MaxFrameSize = 255
+// MaxFrameSize is the size of the largest frame, header included. On the wire
+// every frame is preceded by its size as an uvarint.
+const MaxFrameSize = 64 * 1024
+
+// MinFrameSize is the smallest frame size of a stream, it fits a first frame
+// with the longest destination and one byte of contents
+const MinFrameSize = FrameHeaderSize + 1 + MaxDestinationSize + 1
+
+// DEFAULT_FRAME_SIZE is the frame size of new streams
+const DEFAULT_FRAME_SIZE = 4096
 
 type FrameHeader struct {
 	Id          MsgId
@@ -43,7 +61,7 @@ type FrameHeader struct {
 }
 
 func (f *FrameHeader) String() string {
-	return fmt.Sprintf("{Id:%v,FirstFrame:%v, LastFrame:%v, FrameNum:%v, Dest:%v}", f.Id, f.Flags.Is(FIRSTFRAME), f.Flags.Is(LASTFRAME), f.FrameNumber, f.Dest)
+	return fmt.Sprintf("{Id:%v,FirstFrame:%v, LastFrame:%v, Abort:%v, FrameNum:%v, Dest:%v}", f.Id, f.Flags.Is(FIRSTFRAME), f.Flags.Is(LASTFRAME), f.Flags.Is(ABORT), f.FrameNumber, f.Dest)
 }
 
 func (f *FrameHeader) write(buf *[]byte) {
@@ -69,14 +87,14 @@ func (f *FrameHeader) read(buf []byte) error {
 	f.FrameNumber = binary.BigEndian.Uint64(buf[16:24])
 	f.Flags = Flags(buf[24])
 	if f.Flags.Is(FIRSTFRAME) {
-		if len(buf) < 25 {
-			return fmt.Errorf("Illegal buffer size for a first frame %v < 25 Buffer:%v", len(buf), buf)
+		if len(buf) < FrameHeaderSize+1 {
+			return fmt.Errorf("Illegal buffer size for a first frame %v < %v", len(buf), FrameHeaderSize+1)
 		}
-		destLen := int(buf[25])
-		if len(buf) < 25+destLen {
-			return fmt.Errorf("Illegal buffer size for a first frame %v < %v (header:25,dest:%v) Buffer:%v", len(buf), 25+destLen, destLen, buf)
+		destLen := int(buf[FrameHeaderSize])
+		if len(buf) < FrameHeaderSize+1+destLen {
+			return fmt.Errorf("Illegal buffer size for a first frame %v < %v (header:%v,dest:%v)", len(buf), FrameHeaderSize+1+destLen, FrameHeaderSize+1, destLen)
 		}
-		f.Dest = string(buf[26 : 25+destLen+1])
+		f.Dest = string(buf[FrameHeaderSize+1 : FrameHeaderSize+1+destLen])
 	}
 	return nil
 }
@@ -84,12 +102,28 @@ func (f *FrameHeader) read(buf []byte) error {
 type Frame struct {
 	FrameHeader
 	buffer []byte
+	// refs counts the owners of the frame besides the first one
+	refs int32
 }
 
 func (f *Frame) Buffer() []byte {
 	return f.buffer
 }
 
+// retain adds n owners to the frame, when a frame is sent to several
+// connections each of them owns it
+func (f *Frame) retain(n int) {
+	atomic.AddInt32(&f.refs, int32(n))
+}
+
+// Release returns the frame buffer to the pool once every owner of the frame
+// released it, the frame must not be used by the caller afterwards.
+func (f *Frame) Release() {
+	if atomic.AddInt32(&f.refs, -1) < 0 {
+		frameBuffers.Return(f.buffer)
+	}
+}
+
 func (f *Frame) Contents() []byte {
 	var headerSize int
 	if len(f.Dest) > 0 {
@@ -100,25 +134,149 @@ func (f *Frame) Contents() []byte {
 	return f.buffer[headerSize:]
 }
 
+// redirect returns the frames replacing the first frame f for dest, f is
+// released unless they can not be created. Contents that no longer fit in the
+// first frame move to a second one, the following frames of the stream must
+// then be renumbered.
+func (f *Frame) redirect(dest string) ([]*Frame, error) {
+	contents := f.Contents()
+	header := f.FrameHeader
+	header.Dest = dest
+	room := MaxFrameSize - FrameHeaderSize - (len(dest) + 1)
+	if room < 0 {
+		return nil, fmt.Errorf("Destination %v too long for a frame", dest)
+	}
+	if len(contents) <= room {
+		res, err := NewFrame(header, contents)
+		if err != nil {
+			return nil, err
+		}
+		f.Release()
+		return []*Frame{&res}, nil
+	}
+	next := FrameHeader{Id: f.Id, FrameNumber: 1}
+	if header.Flags.Is(LASTFRAME) {
+		header.Flags &^= LASTFRAME
+		next.Flags = LASTFRAME
+	}
+	first, err := NewFrame(header, contents[:room])
+	if err != nil {
+		return nil, err
+	}
+	second, err := NewFrame(next, contents[room:])
+	if err != nil {
+		first.Release()
+		return nil, err
+	}
+	f.Release()
+	return []*Frame{&first, &second}, nil
+}
+
+// renumber sets the frame number of f, in its header and its buffer
+func (f *Frame) renumber(number uint64) {
+	f.FrameNumber = number
+	binary.BigEndian.PutUint64(f.buffer[16:24], number)
+}
+
+// split returns copies of f numbered from number on, in as many frames of at
+// most size bytes as needed. The first copy keeps the first frame flag and the
+// destination, the last one the last frame flag. The reason of an abort frame
+// is truncated to fit in one frame. f is released unless they can not be
+// created.
+func (f *Frame) split(size int, number uint64) ([]*Frame, error) {
+	contents := f.Contents()
+	header := f.FrameHeader
+	var res []*Frame
+	for len(res) == 0 || len(contents) > 0 {
+		header.FrameNumber = number + uint64(len(res))
+		header.Flags = f.Flags &^ (LASTFRAME | ABORT)
+		header.Dest = ""
+		room := size - FrameHeaderSize
+		if len(res) == 0 && f.Flags.Is(FIRSTFRAME) {
+			header.Dest = f.Dest
+			room -= len(f.Dest) + 1
+		} else {
+			header.Flags &^= FIRSTFRAME | HEADERS
+		}
+		if room <= 0 {
+			return nil, fmt.Errorf("Frame size %v too small for %v", size, f.String())
+		}
+		if f.Flags.Is(ABORT) && room < len(contents) {
+			contents = contents[:room]
+		}
+		if room >= len(contents) {
+			room = len(contents)
+			header.Flags |= f.Flags & (LASTFRAME | ABORT)
+		}
+		piece, err := NewFrame(header, contents[:room])
+		if err != nil {
+			for _, r := range res {
+				r.Release()
+			}
+			return nil, err
+		}
+		res = append(res, &piece)
+		contents = contents[room:]
+	}
+	f.Release()
+	return res, nil
+}
+
 func (f *Frame) String() string {
 	return fmt.Sprintf("Frame{Header:%v, ContentsLength:%v}", f.FrameHeader.String(), len(f.Contents()))
 }
 
 func NewFrame(header FrameHeader, data []byte) (Frame, error) {
 	f := Frame{FrameHeader: header}
-	var remaining int = MaxFrameSize - FrameHeaderSize
+	headerSize := FrameHeaderSize
 	if f.Flags.Is(FIRSTFRAME) {
-		remaining -= (len(f.Dest) + 1)
+		if len(f.Dest) > MaxDestinationSize {
+			return f, fmt.Errorf("Destination too long for a frame (%v>%v)", len(f.Dest), MaxDestinationSize)
+		}
+		headerSize += len(f.Dest) + 1
 	}
-	if len(data) > remaining {
-		return f, fmt.Errorf("Provided data(%v bytes) too long for frame (max size: %v bytes)", len(data), remaining)
+	if len(data) > MaxFrameSize-headerSize {
+		return f, fmt.Errorf("Provided data(%v bytes) too long for frame (max size: %v bytes)", len(data), MaxFrameSize-headerSize)
 	}
-	f.buffer = frameBuffers.Get()
+	f.buffer = frameBuffers.Get(headerSize + len(data))
 	f.write(&f.buffer)
 	f.buffer = append(f.buffer, data...)
 	return f, nil
 }
 
+// writeFrame writes the size of f as an uvarint followed by f to w
+func writeFrame(w io.Writer, f *Frame) error {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(f.buffer)))
+	buffers := net.Buffers{size[:n], f.buffer}
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+// readFrame reads a frame written by writeFrame from r, frames larger than
+// maxSize are rejected
+func readFrame(r *bufio.Reader, maxSize int) (*Frame, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(maxSize) || size < FrameHeaderSize {
+		return nil, fmt.Errorf("Illegal frame size %v, expected %v to %v", size, FrameHeaderSize, maxSize)
+	}
+	buf := frameBuffers.Get(int(size))[:size]
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		frameBuffers.Return(buf)
+		return nil, err
+	}
+	f, err := ReadFrame(buf)
+	if err != nil {
+		frameBuffers.Return(buf)
+		return nil, err
+	}
+	return &f, nil
+}
+
 func ReadFrame(buffer []byte) (Frame, error) {
 	res := Frame{}
 	if len(buffer) > MaxFrameSize {
@@ -0,0 +1,154 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A process connecting to hyenad first sends a Hello, hyenad answers with a
+// Welcome telling the parameters of the connection, or why it is rejected,
+// and closes rejected connections. Frames only follow an accepted Welcome.
+//
+// Both messages are HANDSHAKE_MAGIC, the protocol version of the sender as an
+// uvarint, and a JSON body preceded by its size as an uvarint. Fields unknown
+// to the receiver are ignored, so new parameters do not need a new version.
+
+const HANDSHAKE_MAGIC = "HYNA"
+
+// PROTOCOL_VERSION is the version of the frame format and handshake spoken by
+// this package
+const PROTOCOL_VERSION = 1
+
+// HANDSHAKE_TIMEOUT is the time both sides wait for the handshake of the other
+const HANDSHAKE_TIMEOUT = 5 * time.Second
+
+// MaxHandshakeSize is the size of the largest handshake body
+const MaxHandshakeSize = 4096
+
+// Capabilities are the optional protocol features of a connection, each one a
+// bit. The connection uses the ones both sides support.
+type Capabilities uint64
+
+// SUPPORTED_CAPABILITIES are the capabilities hyenad accepts
+const SUPPORTED_CAPABILITIES Capabilities = 0
+
+func (c Capabilities) Has(capability Capabilities) bool {
+	return c&capability == capability
+}
+
+// Hello opens a connection to hyenad
+type Hello struct {
+	// Name identifies the process in the logs of hyenad
+	Name string `json:"name,omitempty"`
+	// Pid is the process id requested by the process
+	Pid          uint32       `json:"pid"`
+	Capabilities Capabilities `json:"capabilities,omitempty"`
+	// MaxFrameSize is the size of the largest frame the process accepts, it
+	// defaults to MaxFrameSize
+	MaxFrameSize int `json:"maxFrameSize,omitempty"`
+}
+
+// Welcome answers a Hello
+type Welcome struct {
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason,omitempty"`
+	// Version is the protocol version of the connection
+	Version      uint64       `json:"version,omitempty"`
+	Capabilities Capabilities `json:"capabilities,omitempty"`
+	// MaxFrameSize is the size of the largest frame sent on the connection,
+	// in both directions
+	MaxFrameSize int `json:"maxFrameSize,omitempty"`
+	// Node is the node of hyenad, the client is the process Hello.Pid on it
+	Node uint32 `json:"node,omitempty"`
+}
+
+func writeHandshake(w io.Writer, message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBufferString(HANDSHAKE_MAGIC)
+	var size [binary.MaxVarintLen64]byte
+	buf.Write(size[:binary.PutUvarint(size[:], PROTOCOL_VERSION)])
+	buf.Write(size[:binary.PutUvarint(size[:], uint64(len(body)))])
+	buf.Write(body)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// readHandshake reads a handshake message from r and returns the protocol
+// version of the sender, message is only decoded for known versions
+func readHandshake(r *bufio.Reader, message interface{}) (uint64, error) {
+	var magic [len(HANDSHAKE_MAGIC)]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return 0, err
+	}
+	if string(magic[:]) != HANDSHAKE_MAGIC {
+		return 0, fmt.Errorf("Invalid handshake magic %q", magic[:])
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return version, err
+	}
+	if size > MaxHandshakeSize {
+		return version, fmt.Errorf("Handshake of %v bytes over %v", size, MaxHandshakeSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return version, err
+	}
+	if version != PROTOCOL_VERSION {
+		return version, nil
+	}
+	return version, json.Unmarshal(body, message)
+}
+
+// welcome returns the answer of hyenad to hello, sent with version, for a
+// daemon accepting frames up to maxFrameSize
+func welcome(version uint64, hello Hello, maxFrameSize int) Welcome {
+	if version != PROTOCOL_VERSION {
+		return Welcome{Reason: fmt.Sprintf("Unsupported protocol version %v, hyenad speaks %v", version, PROTOCOL_VERSION)}
+	}
+	if hello.Pid == DAEMON_PID {
+		return Welcome{Reason: fmt.Sprintf("Process id %v is reserved for hyenad", hello.Pid)}
+	}
+	if hello.MaxFrameSize == 0 {
+		hello.MaxFrameSize = MaxFrameSize
+	}
+	if hello.MaxFrameSize < MinFrameSize {
+		return Welcome{Reason: fmt.Sprintf("Max frame size %v under %v", hello.MaxFrameSize, MinFrameSize)}
+	}
+	if hello.MaxFrameSize < maxFrameSize {
+		maxFrameSize = hello.MaxFrameSize
+	}
+	return Welcome{
+		Accepted:     true,
+		Version:      PROTOCOL_VERSION,
+		Capabilities: hello.Capabilities & SUPPORTED_CAPABILITIES,
+		MaxFrameSize: maxFrameSize,
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWelcome(t *testing.T) {
+	accepted := welcome(PROTOCOL_VERSION, Hello{Pid: 3, MaxFrameSize: 1024, Capabilities: 1 << 40}, MaxFrameSize)
+	if !accepted.Accepted || accepted.MaxFrameSize != 1024 || accepted.Capabilities != 0 {
+		t.Errorf("Unexpected welcome %+v", accepted)
+	}
+	if w := welcome(PROTOCOL_VERSION, Hello{Pid: 3}, 8192); w.MaxFrameSize != 8192 {
+		t.Errorf("Expected the max frame size of hyenad, got %+v", w)
+	}
+	rejected := map[string]Welcome{
+		"Unsupported protocol version": welcome(PROTOCOL_VERSION+1, Hello{Pid: 3}, MaxFrameSize),
+		"reserved":                     welcome(PROTOCOL_VERSION, Hello{Pid: DAEMON_PID}, MaxFrameSize),
+		"Max frame size":               welcome(PROTOCOL_VERSION, Hello{Pid: 3, MaxFrameSize: 100}, MaxFrameSize),
+	}
+	for reason, w := range rejected {
+		if w.Accepted || !strings.Contains(w.Reason, reason) {
+			t.Errorf("Expected a rejection for %v, got %+v", reason, w)
+		}
+	}
+}
+
+func TestHandshakeUnknownVersion(t *testing.T) {
+	wire := bytes.Buffer{}
+	wire.WriteString(HANDSHAKE_MAGIC)
+	// Version 9 with a body that is not JSON
+	wire.Write([]byte{9, 3, 'a', 'b', 'c'})
+	version, err := readHandshake(bufio.NewReader(&wire), &Hello{})
+	if err != nil || version != 9 {
+		t.Errorf("Expected version 9 without error, got %v, %v", version, err)
+	}
+	wire.Reset()
+	wire.Write([]byte{0, 0, 0, 3})
+	if _, err := readHandshake(bufio.NewReader(&wire), &Hello{}); err == nil {
+		t.Errorf("Expected the raw pid of old clients to be rejected")
+	}
+}
+
+// connect runs a handshake with factory over a pipe
+func connect(factory *LocalConnectionFactory, hello Hello) (net.Conn, *bufio.Reader, Welcome, error) {
+	server, client := net.Pipe()
+	go factory.accept(server)
+	reply := Welcome{}
+	err := writeHandshake(client, hello)
+	if err != nil {
+		return client, nil, reply, err
+	}
+	reader := bufio.NewReader(client)
+	_, err = readHandshake(reader, &reply)
+	return client, reader, reply, err
+}
+
+func TestLocalConnectionHandshake(t *testing.T) {
+	InitFrameBuffers()
+	recv := make(chan *Frame, 16)
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), recv: recv, maxFrameSize: MaxFrameSize}
+	client, reader, reply, err := connect(factory, Hello{Name: "test", Pid: 7, MaxFrameSize: MinFrameSize})
+	if err != nil || !reply.Accepted || reply.MaxFrameSize != MinFrameSize {
+		t.Fatalf("Expected the connection accepted, got %+v, %v", reply, err)
+	}
+	defer client.Close()
+	second, _, reply, err := connect(factory, Hello{Pid: 7})
+	if err != nil || reply.Accepted || !strings.Contains(reply.Reason, "already connected") {
+		t.Errorf("Expected a second connection of pid 7 rejected, got %+v, %v", reply, err)
+	}
+	second.Close()
+	// Frames larger than the max frame size of the process are split
+	conn, err := factory.Get(Address{0, 7}, recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)
+	first, _ := NewFrame(FrameHeader{Id: CreateMid(0, 1, 1), Flags: FIRSTFRAME, Dest: "s:/test"}, []byte(data))
+	last, _ := NewFrame(FrameHeader{Id: CreateMid(0, 1, 1), FrameNumber: 1, Flags: LASTFRAME}, []byte("!"))
+	conn.Send(&first)
+	conn.Send(&last)
+	received := ""
+	for i := uint64(0); ; i++ {
+		f, err := readFrame(reader, MinFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.FrameNumber != i {
+			t.Errorf("Expected frame %v, got %v", i, f.String())
+		}
+		received += string(f.Contents())
+		if f.Flags.Is(LASTFRAME) {
+			f.Release()
+			break
+		}
+		f.Release()
+	}
+	if received != data+"!" {
+		t.Errorf("Expected the split frames to carry the contents, got %q", received)
+	}
+}
+
+func TestLocalConnectionRejectsForeignIds(t *testing.T) {
+	InitFrameBuffers()
+	recv := make(chan *Frame, 16)
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), recv: recv, maxFrameSize: MaxFrameSize}
+	client, _, reply, err := connect(factory, Hello{Name: "test", Pid: 5})
+	if err != nil || !reply.Accepted {
+		t.Fatalf("Expected the connection accepted, got %+v, %v", reply, err)
+	}
+	defer client.Close()
+	for _, id := range []MsgId{CreateMid(0, 1, 1), CreateMid(0, 5, 2)} {
+		f, _ := NewFrame(FrameHeader{Id: id, Flags: FIRSTFRAME | LASTFRAME, Dest: ROUTING_PREFIX + "/update"}, nil)
+		if err := writeFrame(client, &f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case f := <-recv:
+		if f.Id != CreateMid(0, 5, 2) {
+			t.Errorf("Expected the frame with the id of process 5, got %v", f.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a frame")
+	}
+	select {
+	case f := <-recv:
+		t.Errorf("Unexpected frame %v", f.String())
+	default:
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DEFAULT_HASH_REPLICAS is the number of virtual nodes per target of a
+// HashSharded rule that does not set Replicas
+const DEFAULT_HASH_REPLICAS = 64
+
+// HashSharded spreads shard keys over its targets with a consistent hash
+// ring, adding or removing a target only moves the keys it owns.
+type HashSharded struct {
+	Targets Addresses `json:"targets,omitempty"`
+	// Replicas is the number of virtual nodes per target on the ring
+	Replicas int `json:"replicas,omitempty"`
+}
+
+type ringPoint struct {
+	hash    uint64
+	address Address
+}
+
+type hashRing struct {
+	points  []ringPoint
+	targets int
+}
+
+func newHashRing(targets Addresses, replicas int) hashRing {
+	if replicas <= 0 {
+		replicas = DEFAULT_HASH_REPLICAS
+	}
+	ring := hashRing{points: make([]ringPoint, 0, len(targets)*replicas)}
+	seen := make(map[Address]bool)
+	for _, t := range targets {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		ring.targets++
+		node := strconv.Itoa(int(t.Node)) + "." + strconv.Itoa(int(t.Process)) + "#"
+		for i := 0; i < replicas; i++ {
+			ring.points = append(ring.points, ringPoint{hash: hashKey(node + strconv.Itoa(i)), address: t})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return mix64(h.Sum64())
+}
+
+// lookup returns the distinct targets met walking the ring clockwise from key,
+// the owner of key first and its successors as failover targets.
+func (h hashRing) lookup(key string) Addresses {
+	points := h.points
+	if len(points) == 0 {
+		return Addresses{}
+	}
+	hash := hashKey(key)
+	start := sort.Search(len(points), func(i int) bool {
+		return points[i].hash >= hash
+	})
+	res := make(Addresses, 0, h.targets)
+	for i := 0; i < len(points) && len(res) < h.targets; i++ {
+		a := points[(start+i)%len(points)].address
+		if !res.contains(a) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// hashShardRule is the routing tree item of a HashSharded rule
+type hashShardRule struct {
+	HashSharded
+	ring hashRing
+}
+
+func newHashShardRule(rule HashSharded) *hashShardRule {
+	return &hashShardRule{HashSharded: rule, ring: newHashRing(rule.Targets, rule.Replicas)}
+}
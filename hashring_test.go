@@ -0,0 +1,67 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingMoves(t *testing.T) {
+	before := newHashRing(Addresses{Address{0, 1}, Address{0, 2}, Address{0, 3}}, 0)
+	after := newHashRing(Addresses{Address{0, 1}, Address{0, 2}, Address{0, 3}, Address{0, 4}}, 0)
+	keys := 10000
+	moved := 0
+	owned := make(map[Address]int)
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		from := before.lookup(key)
+		to := after.lookup(key)
+		if len(from) != 3 || len(to) != 4 {
+			t.Fatalf("Expected every target in lookup, got %v and %v", from, to)
+		}
+		owned[from[0]]++
+		if from[0] != to[0] {
+			moved++
+			if to[0] != (Address{0, 4}) {
+				t.Errorf("Key %v moved from %v to %v instead of the new target", key, from[0], to[0])
+			}
+		}
+	}
+	if moved > keys/2 || moved < keys/10 {
+		t.Errorf("Expected about a quarter of the keys to move, %v of %v moved", moved, keys)
+	}
+	for a, n := range owned {
+		if n < keys/6 {
+			t.Errorf("Target %v only owns %v keys of %v", a, n, keys)
+		}
+	}
+}
+
+func TestHashShardedRouting(t *testing.T) {
+	routing := NewRoutingTree()
+	targets := Addresses{Address{0, 1}, Address{0, 2}}
+	routing.UpsertHashShardedRule("s:/users/", HashSharded{Targets: targets})
+	first := routing.Route(MustParseDestination("s:/users/42/avatar")).Addresses
+	if len(first) != 2 {
+		t.Fatalf("Expected both targets, got %v", first)
+	}
+	check("s:/users/42/profile", first, routing, t)
+	update := routing.Diff(RoutingTreeUpdate{HashShards: map[string]HashSharded{"s:/users/": HashSharded{Targets: targets}}})
+	if len(update.HashShards) != 0 || len(update.Deletes) != 0 {
+		t.Errorf("Expected no difference, got %v", update)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The first frame of a stream with headers has the HEADERS flag, its contents
+// start with the header block: the size of the block as an uvarint, then for
+// every header the size of the key as an uvarint, the key, the size of the
+// value as an uvarint and the value. The block is part of the contents of the
+// stream, it continues on the following frames when it does not fit in the
+// first one.
+
+// MaxHeadersSize is the size of the largest header block
+const MaxHeadersSize = 64 * 1024
+
+// Well known headers
+const (
+	HEADER_CONTENT_TYPE   = "content-type"
+	HEADER_REPLY_TO       = "reply-to"
+	HEADER_CORRELATION_ID = "correlation-id"
+	HEADER_TRACE_ID       = "trace-id"
+	// HEADER_ERROR marks a reply telling why a request failed
+	HEADER_ERROR = "error"
+)
+
+// Headers are the metadata of a stream
+type Headers map[string]string
+
+// encodeHeaders returns the header block of headers, keys sorted
+func encodeHeaders(headers Headers) []byte {
+	keys := sortedKeys(headers)
+	var body []byte
+	var size [binary.MaxVarintLen64]byte
+	for _, key := range keys {
+		body = append(body, size[:binary.PutUvarint(size[:], uint64(len(key)))]...)
+		body = append(body, key...)
+		body = append(body, size[:binary.PutUvarint(size[:], uint64(len(headers[key])))]...)
+		body = append(body, headers[key]...)
+	}
+	res := append([]byte(nil), size[:binary.PutUvarint(size[:], uint64(len(body)))]...)
+	return append(res, body...)
+}
+
+// decodeHeaders decodes the body of a header block, without its size
+func decodeHeaders(body []byte) (Headers, error) {
+	res := make(Headers)
+	for len(body) > 0 {
+		key, rest, err := readHeaderString(body)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := readHeaderString(rest)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = value
+		body = rest
+	}
+	return res, nil
+}
+
+func readHeaderString(p []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) < size {
+		return "", nil, errors.New("Malformed header block")
+	}
+	end := n + int(size)
+	return string(p[n:end]), p[end:], nil
+}
+
+// headerBlockSize returns the size of the header block starting contents,
+// size included, it fails when contents does not hold the size of the block
+func headerBlockSize(contents []byte) (int, error) {
+	size, n := binary.Uvarint(contents)
+	if n <= 0 {
+		return 0, errors.New("Header block size not in the first frame")
+	}
+	if size > MaxHeadersSize {
+		return 0, fmt.Errorf("Header block of %v bytes over %v", size, MaxHeadersSize)
+	}
+	return n + int(size), nil
+}
+
+// Headers returns the headers of the stream of the first frame f when its
+// header block is entirely in f. Readers of frames are not required to parse
+// the headers, the router only peeks at them.
+func (f *Frame) Headers() (Headers, bool) {
+	if !f.Flags.Is(FIRSTFRAME) || !f.Flags.Is(HEADERS) {
+		return nil, false
+	}
+	contents := f.Contents()
+	size, err := headerBlockSize(contents)
+	if err != nil || size > len(contents) {
+		return nil, false
+	}
+	_, n := binary.Uvarint(contents)
+	headers, err := decodeHeaders(contents[n:size])
+	return headers, err == nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeWithHeaders writes data with headers in frames of MinFrameSize
+func writeWithHeaders(id MsgId, dest string, headers Headers, data string) (chan *Frame, error) {
+	frames := make(chan *Frame, 64)
+	stream := NewWriteStream(id, MustParseDestination(dest), frames)
+	stream.SetFrameSize(MinFrameSize)
+	for key, value := range headers {
+		if err := stream.SetHeader(key, value); err != nil {
+			return nil, err
+		}
+	}
+	stream.Write([]byte(data))
+	stream.Close()
+	close(frames)
+	return frames, nil
+}
+
+func TestStreamHeaders(t *testing.T) {
+	InitFrameBuffers()
+	data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)
+	for name, headers := range map[string]Headers{
+		"none":  nil,
+		"small": {HEADER_CONTENT_TYPE: "text/plain", HEADER_CORRELATION_ID: "42"},
+		"large": {HEADER_TRACE_ID: strings.Repeat("t", 1000)},
+	} {
+		expected := Headers{}
+		for key, value := range headers {
+			expected[key] = value
+		}
+		frames, err := writeWithHeaders(CreateMid(0, 0, 1), "s:/test", headers, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := <-frames
+		peeked, ok := first.Headers()
+		if ok != (name == "small") || (ok && !reflect.DeepEqual(peeked, expected)) {
+			t.Errorf("%v: unexpected headers in the first frame %v, %v", name, peeked, ok)
+		}
+		all := make(chan *Frame, 64)
+		all <- first
+		for f := range frames {
+			all <- f
+		}
+		close(all)
+		stream, err := NewReadStream(all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := stream.Headers()
+		if err != nil || !reflect.DeepEqual(read, expected) {
+			t.Errorf("%v: expected headers %v, got %v, %v", name, expected, read, err)
+		}
+		contents, _ := ioutil.ReadAll(&stream)
+		if string(contents) != data {
+			t.Errorf("%v: expected the contents without headers, got %q", name, contents)
+		}
+	}
+}
+
+func TestSetHeaderAfterWrite(t *testing.T) {
+	stream := NewWriteStream(CreateMid(0, 0, 1), MustParseDestination("s:/test"), make(chan *Frame, 4))
+	if err := stream.SetHeader("", "value"); err == nil {
+		t.Errorf("Expected empty header keys to be rejected")
+	}
+	if err := stream.SetHeader(HEADER_TRACE_ID, strings.Repeat("t", MaxHeadersSize)); err == nil {
+		t.Errorf("Expected headers over MaxHeadersSize to be rejected")
+	}
+	stream.Write([]byte("data"))
+	if err := stream.SetHeader(HEADER_CONTENT_TYPE, "text/plain"); err == nil {
+		t.Errorf("Expected headers set after a write to be rejected")
+	}
+}
+
+func TestDeadLetterHeaders(t *testing.T) {
+	small := Headers{HEADER_CONTENT_TYPE: "text/plain"}
+	// The large header block spans two frames, the router does not decode it
+	large := Headers{HEADER_CONTENT_TYPE: "text/plain", HEADER_TRACE_ID: strings.Repeat("t", 300)}
+	for _, headers := range []Headers{small, large} {
+		dead := &collectingConnection{}
+		deadLetter := "s:/dead"
+		routing := NewRoutingTree()
+		routing.Apply(RoutingTreeUpdate{
+			Services:   map[string]Simple{"s:/dead": Simple{Targets: Addresses{Address{0, 9}}}},
+			DeadLetter: &deadLetter,
+		})
+		router := NewRouter(routing, mapConnectionFactory{Address{0, 9}: dead})
+		data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)
+		frames, _ := writeWithHeaders(CreateMid(0, 0, 1), "s:/nowhere", headers, data)
+		for f := range frames {
+			router.Recv() <- f
+		}
+		time.Sleep(100 * time.Millisecond)
+		router.Stop()
+		lines := strings.SplitN(dead.String(), "\n", 2)
+		if len(lines) != 2 {
+			t.Fatalf("Expected a dead letter header line, got %q", dead.String())
+		}
+		record := DeadLetter{}
+		if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+			t.Fatal(err)
+		}
+		if len(headers) == 1 && !reflect.DeepEqual(record.Headers, headers) {
+			t.Errorf("Expected headers %v in the dead letter, got %v", headers, record.Headers)
+		}
+		if len(headers) > 1 && record.Headers != nil {
+			t.Errorf("Unexpected headers %v", record.Headers)
+		}
+		if lines[1] != data {
+			t.Errorf("Expected the contents without the header block, got %q", lines[1])
+		}
+	}
+}
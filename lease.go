@@ -0,0 +1,86 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"sort"
+	"time"
+)
+
+// Lease is a target added to the routing for a limited time
+type Lease struct {
+	Registration Registration `json:"registration"`
+	Address      Address      `json:"address"`
+	Expires      time.Time    `json:"expires"`
+}
+
+type leaseKey struct {
+	registration Registration
+	address      Address
+}
+
+// Leases returns the current leases, the first to expire first
+func (r *RoutingTree) Leases() []Lease {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := make([]Lease, 0, len(r.leases))
+	for _, lease := range r.leases {
+		res = append(res, *lease)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Expires.Before(res[j].Expires)
+	})
+	return res
+}
+
+// Renew extends every lease of address by its TTL from now, it returns the
+// number of leases renewed
+func (r *RoutingTree) Renew(address Address) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	renewed := 0
+	for key, lease := range r.leases {
+		if key.address == address {
+			lease.Expires = now.Add(lease.Registration.TTL)
+			renewed++
+		}
+	}
+	return renewed
+}
+
+// Expire removes the targets whose lease expired before now, rules left
+// without targets are removed. It returns the expired leases.
+func (r *RoutingTree) Expire(now time.Time) []Lease {
+	var expired []Lease
+	r.lock.Lock()
+	for key, lease := range r.leases {
+		if lease.Expires.Before(now) {
+			expired = append(expired, *lease)
+			delete(r.leases, key)
+			delete(r.registered, key)
+		}
+	}
+	if len(expired) > 0 {
+		t := r.load().clone()
+		for _, lease := range expired {
+			t.removeTarget(lease.Registration, lease.Address)
+		}
+		r.table.Store(t)
+	}
+	r.lock.Unlock()
+	return expired
+}
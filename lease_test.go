@@ -0,0 +1,58 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoutingTreeLeases(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/test", Simple{Targets: Addresses{Address{0, 1}}})
+	leased := Registration{Prefix: "s:/test", TTL: time.Minute}
+	if err := routing.AddTarget(leased, Address{0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := routing.AddTarget(Registration{Prefix: "s:/other", TTL: time.Minute}, Address{0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := routing.AddTarget(Registration{Prefix: "s:/test", TTL: time.Second}, Address{0, 3}); err != nil {
+		t.Fatal(err)
+	}
+	// Registering again without TTL makes the target permanent
+	if err := routing.AddTarget(Registration{Prefix: "s:/test"}, Address{0, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if leases := routing.Leases(); len(leases) != 2 {
+		t.Fatalf("Expected 2 leases, got %v", leases)
+	}
+	if expired := routing.Expire(time.Now().Add(30 * time.Second)); len(expired) != 0 {
+		t.Errorf("Expected no expired lease, got %v", expired)
+	}
+	if renewed := routing.Renew(Address{0, 2}); renewed != 2 {
+		t.Errorf("Expected 2 renewed leases, got %v", renewed)
+	}
+	expired := routing.Expire(time.Now().Add(2 * time.Minute))
+	if len(expired) != 2 || expired[0].Address != (Address{0, 2}) {
+		t.Errorf("Expected the leases of 0.2 to expire, got %v", expired)
+	}
+	check("s:/test/a", Addresses{Address{0, 1}, Address{0, 3}}, routing, t)
+	check("s:/other/a", Addresses{}, routing, t)
+	if leases := routing.Leases(); len(leases) != 0 {
+		t.Errorf("Expected no lease left, got %v", leases)
+	}
+}
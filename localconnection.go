@@ -16,81 +16,187 @@ limitations under the License.
 package hyenad
 
 import (
-	"encoding/binary"
+	"bufio"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+// LOCAL_SEND_QUEUE is the number of frames queued for a local process before
+// it is congested: new streams are refused, and the writers of its streams in
+// flight stop being read until the queue drains to half. Up to
+// LOCAL_SEND_OVERFLOW more frames of streams in flight are queued meanwhile.
+// Send fails beyond them, or once the process stayed congested for
+// LOCAL_THROTTLE_TIMEOUT. Send never blocks, so a slow process never blocks
+// the router. LOCAL_ABORT_RESERVE more abort frames can be queued, they tell
+// the process about the streams cut by a failed send.
+const (
+	LOCAL_SEND_QUEUE        = 256
+	LOCAL_SEND_OVERFLOW     = 512
+	LOCAL_ABORT_RESERVE     = 64
+	LOCAL_THROTTLE_TIMEOUT  = 5 * time.Second
+	LOCAL_THROTTLE_INTERVAL = time.Millisecond
 )
 
 type LocalConnection struct {
 	conn   net.Conn
-	closed uint32
-	recv   chan<- *Frame
-	send   chan *Frame
+	reader *bufio.Reader
+	name   string
+	// address is the process given in the handshake on the local node, frames
+	// sent by the process must carry it in their id
+	address   Address
+	closed    uint32
+	recv      chan<- *Frame
+	send      chan *Frame
+	onClose   func(l *LocalConnection)
+	closeOnce sync.Once
+	// maxFrameSize is the size of the largest frame accepted on the
+	// connection, in both directions
+	maxFrameSize int
+	// congested are the connections the process writes to faster than they
+	// drain, read waits for them before reading the next frame
+	congested    []Connection
+	throttleLock sync.Mutex
+	// congestedSince is the UnixNano time the send queue became congested, 0
+	// while it is not
+	congestedSince int64
 }
 
-func newLocalConnection(pid uint32, conn net.Conn, recv chan<- *Frame) *LocalConnection {
+// newLocalConnection returns the connection of the process at address whose
+// handshake was read from reader, frames are only exchanged once it is started
+func newLocalConnection(conn net.Conn, reader *bufio.Reader, address Address, name string, maxFrameSize int, recv chan<- *Frame, onClose func(l *LocalConnection)) *LocalConnection {
 	res := LocalConnection{}
+	res.onClose = onClose
 	res.conn = conn
-	res.send = make(chan *Frame)
+	res.reader = reader
+	res.name = name
+	res.address = address
+	res.send = make(chan *Frame, LOCAL_SEND_QUEUE+LOCAL_SEND_OVERFLOW+LOCAL_ABORT_RESERVE)
+	res.maxFrameSize = maxFrameSize
 	res.recv = recv
-	go res.write()
-	go res.read()
 	return &res
 }
 
+func (l *LocalConnection) start() {
+	go l.write()
+	go l.read()
+}
+
+// write writes the frames sent to the process, frames larger than the
+// maximum of the connection are split and the following frames of their
+// stream renumbered
 func (l *LocalConnection) write() {
+	offsets := make(map[MsgId]uint64)
 	for f := range l.send {
-		buf := f.Buffer()
-		size := byte(len(buf))
-		n, err := l.conn.Write([]byte{size})
-		if err != nil || n != 1 {
-			log.WithError(err).WithField("Wrote", n).Error("Writing frame size")
-			frameBuffers.Return(buf)
-			break
+		frames := []*Frame{f}
+		id, last := f.Id, f.Flags.Is(LASTFRAME)
+		offset := offsets[id]
+		if offset > 0 || len(f.Buffer()) > l.maxFrameSize {
+			var err error
+			frames, err = f.split(l.maxFrameSize, f.FrameNumber+offset)
+			if err != nil {
+				log.WithField("Name", l.name).WithField("Frame", f.String()).WithError(err).Error("Splitting frame")
+				f.Release()
+				continue
+			}
+			if len(frames) > 1 {
+				offsets[id] = offset + uint64(len(frames)-1)
+			}
 		}
-		n, err = l.conn.Write(buf)
-		if err != nil || n != len(buf) {
-			log.WithError(err).WithField("Wrote", n).WithField("Expected", len(buf)).Error("Writing frame ")
-			frameBuffers.Return(buf)
-			break
+		if last {
+			delete(offsets, id)
+		}
+		for i, frame := range frames {
+			err := writeFrame(l.conn, frame)
+			frame.Release()
+			if err != nil {
+				for _, unsent := range frames[i+1:] {
+					unsent.Release()
+				}
+				log.WithField("Name", l.name).WithError(err).Error("Writing frame")
+				l.Close()
+				return
+			}
 		}
-		frameBuffers.Return(buf)
 	}
 }
 
+// read routes the frames of the process, the streams it was writing when the
+// connection is lost are aborted
 func (l *LocalConnection) read() {
-	size := [1]byte{0}
+	// open are the next frame numbers of the streams written by the process
+	open := make(map[MsgId]uint64)
 	for {
-		n, err := l.conn.Read(size[:])
-		if err != nil || n != 1 {
-			//log.WithError(err).WithField("Read", n).Error("Reading frame size")
-			break
-		}
-		buf := frameBuffers.Get()
-		buf = buf[0:size[0]]
-		n, err = io.ReadFull(l.conn, buf)
-		if err != nil || n != len(buf) {
-			//log.WithError(err).WithField("Read", n).WithField("Expected", len(buf)).Error("Reading frame ")
-			frameBuffers.Return(buf)
-			break
-		}
-		f, err := ReadFrame(buf)
+		l.waitCongested()
+		f, err := readFrame(l.reader, l.maxFrameSize)
 		if err != nil {
-			log.WithField("Size", size[0]).WithError(err).Error("Reading frame")
-			frameBuffers.Return(buf)
+			if err != io.EOF && l.Ok() {
+				log.WithField("Name", l.name).WithError(err).Error("Reading frame")
+			}
 			break
 		}
 		if debug {
 			log.WithField("Frame", f.String()).Debug("RECV")
 		}
-		l.recv <- &f
+		if nid, pid, _ := f.Id.Split(); (Address{nid, pid}) != l.address {
+			log.WithField("Name", l.name).WithField("Address", l.address).WithField("Frame", f.String()).Error("Rejecting frame with the id of another process")
+			f.Release()
+			continue
+		}
+		if f.Flags.Is(LASTFRAME) {
+			delete(open, f.Id)
+		} else {
+			open[f.Id] = f.FrameNumber + 1
+		}
+		l.recv <- f
+	}
+	l.Close()
+	for id, number := range open {
+		abort, err := NewFrame(FrameHeader{Id: id, FrameNumber: number, Flags: LASTFRAME | ABORT}, []byte(fmt.Sprintf("Connection of %v lost", l.name)))
+		if err == nil {
+			l.recv <- &abort
+		}
+	}
+	l.onClose(l)
+}
+
+// throttle stops reading from the process until congested drains, the router
+// calls it when a stream written by the process fills the queue of congested
+func (l *LocalConnection) throttle(congested Connection) {
+	l.throttleLock.Lock()
+	defer l.throttleLock.Unlock()
+	for _, c := range l.congested {
+		if c == congested {
+			return
+		}
+	}
+	l.congested = append(l.congested, congested)
+}
+
+// waitCongested waits until the connections the process writes to drained to
+// half their queue or closed, for at most LOCAL_THROTTLE_TIMEOUT
+func (l *LocalConnection) waitCongested() {
+	deadline := time.Now().Add(LOCAL_THROTTLE_TIMEOUT)
+	for l.Ok() {
+		l.throttleLock.Lock()
+		if len(l.congested) == 0 {
+			l.throttleLock.Unlock()
+			return
+		}
+		c := l.congested[0]
+		if !c.Ok() || c.Queue() <= LOCAL_SEND_QUEUE/2 || time.Now().After(deadline) {
+			l.congested = l.congested[1:]
+			l.throttleLock.Unlock()
+			continue
+		}
+		l.throttleLock.Unlock()
+		time.Sleep(LOCAL_THROTTLE_INTERVAL)
 	}
-	l.conn.Close()
-	atomic.StoreUint32(&l.closed, 1)
 }
 
 func (l *LocalConnection) Queue() int {
@@ -101,9 +207,34 @@ func (l *LocalConnection) Send(frame *Frame) error {
 	if debug {
 		log.WithField("Frame", frame.String()).Debug("Sending frame")
 	}
-	//TODO: Flow Control
-	l.send <- frame
-	return nil
+	if !l.Ok() {
+		frame.Release()
+		return errors.New("Connection closed")
+	}
+	queued := len(l.send)
+	if queued < LOCAL_SEND_QUEUE {
+		atomic.StoreInt64(&l.congestedSince, 0)
+	} else if since := atomic.LoadInt64(&l.congestedSince); since == 0 {
+		atomic.StoreInt64(&l.congestedSince, time.Now().UnixNano())
+	} else if congested := time.Since(time.Unix(0, since)); congested > LOCAL_THROTTLE_TIMEOUT && !frame.Flags.Is(ABORT) {
+		frame.Release()
+		return fmt.Errorf("Send queue congested for %v, %v frames queued", congested, queued)
+	}
+	limit := LOCAL_SEND_QUEUE
+	if frame.FrameNumber > 0 {
+		limit += LOCAL_SEND_OVERFLOW
+	}
+	if queued >= limit && !frame.Flags.Is(ABORT) {
+		frame.Release()
+		return fmt.Errorf("Send queue full, %v frames queued", queued)
+	}
+	select {
+	case l.send <- frame:
+		return nil
+	default:
+		frame.Release()
+		return fmt.Errorf("Send queue full, %v frames queued", len(l.send))
+	}
 }
 
 func (l *LocalConnection) Ok() bool {
@@ -111,28 +242,37 @@ func (l *LocalConnection) Ok() bool {
 }
 
 func (l *LocalConnection) Close() error {
-	err := l.conn.Close()
-	atomic.StoreUint32(&l.closed, 1)
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.conn.Close()
+		atomic.StoreUint32(&l.closed, 1)
+	})
 	return err
 }
 
 const PROCESS_ADDRESS = "localhost:6887"
 
 type LocalConnectionFactory struct {
-	connections map[uint32]*LocalConnection
+	connections map[uint32]Connection
 	lock        sync.RWMutex
 	recv        chan<- *Frame
 	serverConn  net.Listener
+	onClose     func(pid uint32)
+	// maxFrameSize is the size of the largest frame hyenad accepts
+	maxFrameSize int
+	// node is the local node, the only one whose processes the factory serves
+	node uint32
 }
 
-func NewLocalConnectionFactory() (*LocalConnectionFactory, error) {
-	res := LocalConnectionFactory{}
+// NewLocalConnectionFactory listens for the processes of the local node
+func NewLocalConnectionFactory(node uint32) (*LocalConnectionFactory, error) {
+	res := LocalConnectionFactory{maxFrameSize: MaxFrameSize, node: node}
 	var err error
 	res.serverConn, err = net.Listen("tcp", PROCESS_ADDRESS)
 	if err != nil {
 		return &res, err
 	}
-	res.connections = make(map[uint32]*LocalConnection)
+	res.connections = make(map[uint32]Connection)
 	go res.listen()
 	return &res, nil
 }
@@ -147,27 +287,91 @@ func (l *LocalConnectionFactory) listen() {
 		if err != nil {
 			panic(err.Error())
 		}
-		//TODO: Replace with secure tokens
-		// Read ProcessId
-		pid := [4]byte{0, 0, 0, 0}
-		n, err := conn.Read(pid[0:4])
-		if err != nil || n != 4 {
-			conn.Close()
-			log.WithField("Read", n).WithError(err).Error("Reading Connection Header")
+		go l.accept(conn)
+	}
+}
+
+// accept runs the handshake of a new connection and registers the accepted
+// ones as the connection of their process
+func (l *LocalConnectionFactory) accept(conn net.Conn) {
+	//TODO: Replace with secure tokens
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	hello := Hello{}
+	version, err := readHandshake(reader, &hello)
+	if err != nil {
+		log.WithField("Remote", conn.RemoteAddr()).WithError(err).Error("Reading handshake")
+		conn.Close()
+		return
+	}
+	reply := welcome(version, hello, l.maxFrameSize)
+	var connection *LocalConnection
+	if reply.Accepted {
+		pid := hello.Pid
+		reply.Node = l.node
+		connection = newLocalConnection(conn, reader, Address{l.node, pid}, hello.Name, reply.MaxFrameSize, l.recv, func(closed *LocalConnection) {
+			l.closed(pid, closed)
+		})
+		l.lock.Lock()
+		if current, ok := l.connections[pid]; ok && current.Ok() {
+			reply = Welcome{Reason: fmt.Sprintf("Process %v already connected", pid)}
 		} else {
-			pid := binary.BigEndian.Uint32(pid[:])
-			l.lock.Lock()
-			connection := newLocalConnection(pid, conn, l.recv)
 			l.connections[pid] = connection
-			if debug {
-				log.WithField("Pid", pid).Debug("Registering new connection")
-			}
-			l.lock.Unlock()
 		}
+		l.lock.Unlock()
 	}
+	err = writeHandshake(conn, reply)
+	if err != nil || !reply.Accepted {
+		log.WithField("Name", hello.Name).WithField("Pid", hello.Pid).WithField("Version", version).WithField("Reason", reply.Reason).WithError(err).Warn("Rejected connection")
+		conn.Close()
+		if reply.Accepted {
+			connection.Close()
+			l.closed(hello.Pid, connection)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.WithField("Name", hello.Name).WithField("Pid", hello.Pid).WithField("MaxFrameSize", reply.MaxFrameSize).WithField("Capabilities", reply.Capabilities).Info("Accepted connection")
+	connection.start()
 }
 
+// OnClose sets the function called when the connection of a local process
+// closes, it is not called when the process already reconnected.
+func (l *LocalConnectionFactory) OnClose(callback func(pid uint32)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.onClose = callback
+}
+
+func (l *LocalConnectionFactory) closed(pid uint32, connection Connection) {
+	l.lock.Lock()
+	current := l.connections[pid] == connection
+	if current {
+		delete(l.connections, pid)
+	}
+	callback := l.onClose
+	l.lock.Unlock()
+	if debug {
+		log.WithField("Pid", pid).Debug("Connection closed")
+	}
+	if current && callback != nil {
+		callback(pid)
+	}
+}
+
+// Register makes an in-process connection reachable as local process pid
+func (l *LocalConnectionFactory) Register(pid uint32, conn Connection) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.connections[pid] = conn
+}
+
+// Get returns the connection of a process of the local node, hyenad itself is
+// reachable as DAEMON_ADDRESS whatever the node
 func (l *LocalConnectionFactory) Get(address Address, recv chan<- *Frame) (Connection, error) {
+	if address.Node != l.node && address != DAEMON_ADDRESS {
+		return nil, fmt.Errorf("Address %v is not on the local node %v", address, l.node)
+	}
 	l.lock.Lock()
 	defer l.lock.Unlock()
 	conn, ok := l.connections[address.Process]
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"sync"
+	"sync/atomic"
 )
 
 type logConnection string
@@ -73,6 +74,119 @@ func (f *logConnectionFactory) Get(address Address, recv chan<- *Frame) (Connect
 
 type singleTargetRouting struct{}
 
-func (r *singleTargetRouting) Route(destination string) Addresses {
-	return Addresses{Address{0, 1}}
+func (r *singleTargetRouting) Route(destination Destination) Route {
+	return Route{Addresses: Addresses{Address{0, 1}}}
+}
+
+type countingConnection struct {
+	frames uint32
+	ok     bool
+	queue  int
+	// err is returned by Send when set
+	err error
+}
+
+func (c *countingConnection) Queue() int {
+	return c.queue
+}
+
+func (c *countingConnection) Send(frame *Frame) error {
+	atomic.AddUint32(&c.frames, 1)
+	frame.Release()
+	return c.err
+}
+
+func (c *countingConnection) Ok() bool {
+	return c.ok
+}
+
+func (c *countingConnection) Close() error {
+	c.ok = false
+	return nil
+}
+
+func (c *countingConnection) count() uint32 {
+	return atomic.LoadUint32(&c.frames)
+}
+
+type countingConnectionFactory map[Address]*countingConnection
+
+func (f countingConnectionFactory) SetRouter(router Router) {}
+func (f countingConnectionFactory) Get(address Address, recv chan<- *Frame) (Connection, error) {
+	c, ok := f[address]
+	if !ok {
+		return nil, fmt.Errorf("No connection for %v", address)
+	}
+	return c, nil
+}
+
+type staticRouting Route
+
+func (r staticRouting) Route(destination Destination) Route {
+	return Route(r)
+}
+
+// collectingConnection keeps the contents of the frames it receives
+type collectingConnection struct {
+	contents []byte
+	dests    []string
+	numbers  []uint64
+	flags    []Flags
+	// failures are the errors of the sends of frame numbers, abort frames
+	// excepted
+	failures map[uint64]error
+	lock     sync.Mutex
+}
+
+func (c *collectingConnection) Queue() int {
+	return 0
+}
+
+func (c *collectingConnection) Send(frame *Frame) error {
+	if err := c.failures[frame.FrameNumber]; err != nil && !frame.Flags.Is(ABORT) {
+		frame.Release()
+		return err
+	}
+	c.lock.Lock()
+	c.contents = append(c.contents, frame.Contents()...)
+	c.numbers = append(c.numbers, frame.FrameNumber)
+	c.flags = append(c.flags, frame.Flags)
+	if frame.Flags.Is(FIRSTFRAME) {
+		c.dests = append(c.dests, frame.Dest)
+	}
+	c.lock.Unlock()
+	frame.Release()
+	return nil
+}
+
+func (c *collectingConnection) Ok() bool {
+	return true
+}
+
+func (c *collectingConnection) Close() error {
+	return nil
+}
+
+func (c *collectingConnection) String() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return string(c.contents)
+}
+
+// destinations returns the destinations of the streams received
+func (c *collectingConnection) destinations() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.dests...)
+}
+
+type mapConnectionFactory map[Address]Connection
+
+func (f mapConnectionFactory) SetRouter(router Router) {}
+func (f mapConnectionFactory) Get(address Address, recv chan<- *Frame) (Connection, error) {
+	c, ok := f[address]
+	if !ok {
+		return nil, fmt.Errorf("No connection for %v", address)
+	}
+	return c, nil
 }
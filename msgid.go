@@ -56,3 +56,17 @@ func (f *MsgId) ReadFrom(buf []byte) error {
 	copy(f[2:18], buf[0:16])
 	return nil
 }
+
+// ParseMsgId parses the String of a MsgId
+func ParseMsgId(s string) (MsgId, error) {
+	m := MsgId{}
+	decoded, err := SBase64.DecodeString(s)
+	if err != nil {
+		return m, err
+	}
+	if len(decoded) != len(m) {
+		return m, fmt.Errorf("Illegal MessageId %q", s)
+	}
+	copy(m[:], decoded)
+	return m, nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"strings"
+)
+
+// Rule keys are plain prefixes unless one of their "/" separated segments is
+// a wildcard:
+//   *      matches exactly one segment
+//   **     matches any number of segments, including none
+//   {name} matches exactly one segment and captures it as name
+// Single segment wildcards are captured, * without a name.
+// A pattern matches whole segments at the start of a destination, the rest of
+// the destination is free, like for a plain prefix.
+//
+// When several rules match a destination, the most specific one wins: the one
+// with the most literal characters (wildcard segments excluded). On a tie a
+// plain prefix wins over a pattern, and a pattern without ** wins over one
+// with **.
+//
+// Sharded rules use the capture named "shard" as shard key, or the first
+// capture, or the segment following the match when nothing was captured.
+
+const (
+	ANY_SEGMENT  = "*"
+	ANY_SEGMENTS = "**"
+)
+
+type capture struct {
+	name  string
+	value string
+}
+
+type pattern struct {
+	key      string
+	segments []string
+	literals int
+	multi    bool
+}
+
+func isParam(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+func isWildcard(segment string) bool {
+	return segment == ANY_SEGMENT || segment == ANY_SEGMENTS || isParam(segment)
+}
+
+// literalPrefix returns the segments of key before its first wildcard
+func literalPrefix(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		if isWildcard(segment) {
+			return strings.Join(segments[:i], "/")
+		}
+	}
+	return key
+}
+
+// isPattern returns true if key contains a wildcard segment
+func isPattern(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if isWildcard(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePattern(key string) *pattern {
+	res := pattern{key: key, segments: strings.Split(key, "/")}
+	for i, segment := range res.segments {
+		if i > 0 {
+			res.literals++
+		}
+		if segment == ANY_SEGMENTS {
+			res.multi = true
+		} else if !isWildcard(segment) {
+			res.literals += len(segment)
+		}
+	}
+	return &res
+}
+
+// match returns the number of destination segments matched by the pattern
+// and the captured segments.
+func (p *pattern) match(destination []string) (int, []capture, bool) {
+	return matchSegments(p.segments, destination, 0, nil)
+}
+
+func matchSegments(pattern []string, destination []string, consumed int, captures []capture) (int, []capture, bool) {
+	if len(pattern) == 0 {
+		return consumed, captures, true
+	}
+	segment := pattern[0]
+	if segment == ANY_SEGMENTS {
+		for n := 0; n <= len(destination); n++ {
+			res, resCaptures, ok := matchSegments(pattern[1:], destination[n:], consumed+n, captures)
+			if ok {
+				return res, resCaptures, true
+			}
+		}
+		return 0, nil, false
+	}
+	if len(destination) == 0 {
+		return 0, nil, false
+	}
+	switch {
+	case segment == ANY_SEGMENT:
+		captures = append(captures, capture{value: destination[0]})
+	case isParam(segment):
+		captures = append(captures, capture{name: segment[1 : len(segment)-1], value: destination[0]})
+	case segment != destination[0]:
+		return 0, nil, false
+	}
+	return matchSegments(pattern[1:], destination[1:], consumed+1, captures)
+}
+
+// moreSpecific returns true if p takes precedence over o
+func (p *pattern) moreSpecific(o *pattern) bool {
+	if p.literals != o.literals {
+		return p.literals > o.literals
+	}
+	if p.multi != o.multi {
+		return !p.multi
+	}
+	return p.key < o.key
+}
+
+// captures returns true if the pattern captures a segment as name
+func (p *pattern) captures(name string) bool {
+	for _, segment := range p.segments {
+		if isParam(segment) && segment[1:len(segment)-1] == name {
+			return true
+		}
+	}
+	return false
+}
@@ -16,17 +16,38 @@ limitations under the License.
 package hyenad
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"io"
 )
 
+// AbortError is returned by the reads of a stream aborted by its writer
+type AbortError struct {
+	Reason string
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("Stream aborted: %v", e.Reason)
+}
+
 type ReadStream struct {
 	frames       <-chan *Frame
 	currentFrame *Frame
 	dest         string
 	id           MsgId
 	currentIndex int
+	// hasHeaders is set when the stream starts with a header block, it is
+	// decoded by the first Read or Headers call
+	hasHeaders  bool
+	headersRead bool
+	headers     Headers
+	headersErr  error
+	// client is the client that received the stream, it sends the replies
+	client *HyenaClient
+	// aborted is set once the abort frame of the stream is read
+	aborted *AbortError
 }
 
 func NewReadStream(frames <-chan *Frame) (stream ReadStream, err error) {
@@ -40,9 +61,92 @@ func NewReadStream(frames <-chan *Frame) (stream ReadStream, err error) {
 	}
 	res.dest = res.currentFrame.Dest
 	res.id = res.currentFrame.Id
+	res.hasHeaders = res.currentFrame.Flags.Is(HEADERS)
+	res.checkAbort()
 	return res, nil
 }
 
+// Headers returns the headers of the stream, it waits for the frames holding
+// them when the header block spans several frames
+func (r *ReadStream) Headers() (Headers, error) {
+	r.readHeaders()
+	return r.headers, r.headersErr
+}
+
+func (r *ReadStream) readHeaders() {
+	if r.headersRead {
+		return
+	}
+	r.headersRead = true
+	r.headers = Headers{}
+	if !r.hasHeaders {
+		return
+	}
+	size, err := binary.ReadUvarint(contentsByteReader{r})
+	if err == nil && size > MaxHeadersSize {
+		err = fmt.Errorf("Header block of %v bytes over %v", size, MaxHeadersSize)
+	}
+	if err == nil {
+		block := make([]byte, size)
+		_, err = io.ReadFull(contentsReader{r}, block)
+		if err == nil {
+			r.headers, err = decodeHeaders(block)
+		}
+	}
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errors.New("Stream ended in its header block")
+		}
+		r.headersErr = err
+	}
+}
+
+// contentsReader reads the contents of a stream, header block included
+type contentsReader struct {
+	r *ReadStream
+}
+
+func (c contentsReader) Read(p []byte) (int, error) {
+	return c.r.readContents(p)
+}
+
+type contentsByteReader struct {
+	r *ReadStream
+}
+
+func (c contentsByteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(contentsReader{c.r}, b[:])
+	return b[0], err
+}
+
+// Reply sends body to the reply-to header of the stream, or to the
+// ReplyDestination of its id when it has none
+func (r *ReadStream) Reply(body io.Reader) error {
+	if r.client == nil {
+		return errors.New("Stream was not received by a HyenaClient")
+	}
+	headers, err := r.Headers()
+	if err != nil {
+		return err
+	}
+	dest, ok := headers[HEADER_REPLY_TO]
+	if !ok {
+		dest = ReplyDestination(r.id).String()
+	}
+	s, err := r.client.CreateStream(dest)
+	if err != nil {
+		return err
+	}
+	s.SetHeader(HEADER_CORRELATION_ID, r.id.String())
+	_, err = io.Copy(s, body)
+	if err != nil {
+		s.Abort(err)
+		return err
+	}
+	return s.Close()
+}
+
 func (r ReadStream) Destination() string {
 	return r.dest
 }
@@ -51,9 +155,36 @@ func (r ReadStream) MessageId() MsgId {
 	return r.id
 }
 
+// Read reads the contents of the stream after its headers
 func (r *ReadStream) Read(p []byte) (n int, err error) {
+	r.readHeaders()
+	if r.headersErr != nil {
+		return 0, r.headersErr
+	}
+	return r.readContents(p)
+}
+
+// checkAbort ends the stream when the current frame is an abort frame
+func (r *ReadStream) checkAbort() {
+	if r.currentFrame == nil || !r.currentFrame.Flags.Is(ABORT) {
+		return
+	}
+	r.aborted = &AbortError{Reason: string(r.currentFrame.Contents())}
+	r.currentFrame.Release()
+	r.currentFrame = nil
+}
+
+// end returns the error of reads past the end of the stream
+func (r *ReadStream) end() error {
+	if r.aborted != nil {
+		return r.aborted
+	}
+	return io.EOF
+}
+
+func (r *ReadStream) readContents(p []byte) (n int, err error) {
 	if r.currentFrame == nil {
-		return 0, io.EOF
+		return 0, r.end()
 	}
 	size := len(p)
 	wrote := 0
@@ -66,14 +197,15 @@ func (r *ReadStream) Read(p []byte) (n int, err error) {
 			if debug {
 				logrus.WithField("Stream", r).Debug("Waiting for another frame")
 			}
-			frameBuffers.Return(r.currentFrame.buffer)
+			r.currentFrame.Release()
 			r.currentFrame = <-r.frames
 			r.currentIndex = 0
+			r.checkAbort()
 			if r.currentFrame == nil {
 				if debug {
 					logrus.WithField("Stream", r).Debug("Last Frame")
 				}
-				return wrote, io.EOF
+				return wrote, r.end()
 			}
 		} else {
 			if remaining > (size - wrote) {
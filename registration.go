@@ -0,0 +1,190 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"fmt"
+	"gopkg.in/tchap/go-patricia.v2/patricia"
+	"time"
+)
+
+// Registration asks hyenad to add the sender of the request as a target of
+// the Simple rule at Prefix, or of the shard range From-To of the Sharded rule
+// at Prefix when the range is set. A registration with a TTL is a lease, the
+// target is removed unless the lease is renewed within the TTL.
+type Registration struct {
+	Prefix string        `json:"prefix"`
+	From   string        `json:"from,omitempty"`
+	To     string        `json:"to,omitempty"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+}
+
+// target identifies the rule or shard range of the registration
+func (r Registration) target() Registration {
+	r.TTL = 0
+	return r
+}
+
+func (r Registration) sharded() bool {
+	return r.From != "" || r.To != ""
+}
+
+func (r Registration) String() string {
+	if r.sharded() {
+		return fmt.Sprintf("%v[%v-%v]", r.Prefix, r.From, r.To)
+	}
+	return r.Prefix
+}
+
+// AddTarget adds address to the targets of the rule or shard range of
+// registration, creating them when needed. The resulting rule must be valid.
+// The target is leased when registration has a TTL, registering it again
+// renews the lease, or makes it permanent without TTL.
+func (r *RoutingTree) AddTarget(registration Registration, address Address) error {
+	var err error
+	r.update(func(t *routingTable) {
+		err = t.addTarget(registration, address)
+		if err != nil {
+			return
+		}
+		key := leaseKey{registration.target(), address}
+		if _, ok := r.registered[key]; !ok {
+			r.registrations++
+			r.registered[key] = r.registrations
+		}
+		if registration.TTL > 0 {
+			r.leases[key] = &Lease{Registration: registration, Address: address, Expires: time.Now().Add(registration.TTL)}
+		} else {
+			delete(r.leases, key)
+		}
+	})
+	return err
+}
+
+// RemoveTarget removes address added by AddTarget from the targets of the rule
+// or shard range of registration, shard ranges and rules left without targets
+// are removed. Targets that were not registered are left untouched.
+func (r *RoutingTree) RemoveTarget(registration Registration, address Address) {
+	r.update(func(t *routingTable) {
+		key := leaseKey{registration.target(), address}
+		if _, ok := r.registered[key]; !ok {
+			return
+		}
+		t.removeTarget(registration, address)
+		delete(r.leases, key)
+		delete(r.registered, key)
+	})
+}
+
+func (t *routingTable) addTarget(registration Registration, address Address) error {
+	prefix := registration.Prefix
+	if t.capturesReserved(prefix) {
+		return fmt.Errorf("Reserved prefix %v can not be registered", prefix)
+	}
+	if isPattern(prefix) {
+		return fmt.Errorf("Pattern %v can not be registered", prefix)
+	}
+	update := RoutingTreeUpdate{}
+	item := t.trie.Get(patricia.Prefix(prefix))
+	if !registration.sharded() {
+		rule := Simple{}
+		switch existing := item.(type) {
+		case nil:
+		case Simple:
+			rule = existing
+		default:
+			return fmt.Errorf("%v is not a simple rule", prefix)
+		}
+		rule.Targets = withTarget(rule.Targets, address)
+		update.Services = map[string]Simple{prefix: rule}
+	} else {
+		var rule Sharded
+		switch existing := item.(type) {
+		case nil:
+		case Sharded:
+			rule = make(Sharded, len(existing))
+			copy(rule, existing)
+		default:
+			return fmt.Errorf("%v is not a sharded rule", prefix)
+		}
+		found := false
+		for i, shard := range rule {
+			if shard.From == registration.From && shard.To == registration.To {
+				rule[i].Targets = withTarget(shard.Targets, address)
+				found = true
+			}
+		}
+		if !found {
+			rule = append(rule, ShardEntry{From: registration.From, To: registration.To, Targets: Addresses{address}})
+		}
+		update.Shards = map[string]Sharded{prefix: rule}
+	}
+	if err := update.Validate().Err(); err != nil {
+		return err
+	}
+	t.apply(update)
+	return nil
+}
+
+func (t *routingTable) removeTarget(registration Registration, address Address) {
+	prefix := patricia.Prefix(registration.Prefix)
+	switch existing := t.trie.Get(prefix).(type) {
+	case Simple:
+		existing.Targets = withoutTarget(existing.Targets, address)
+		if len(existing.Targets) == 0 && len(existing.Groups) == 0 {
+			t.apply(RoutingTreeUpdate{Deletes: []string{registration.Prefix}})
+		} else {
+			t.set(registration.Prefix, existing)
+		}
+	case Sharded:
+		rule := make(Sharded, 0, len(existing))
+		for _, shard := range existing {
+			if registration.sharded() && shard.From == registration.From && shard.To == registration.To {
+				shard.Targets = withoutTarget(shard.Targets, address)
+				if len(shard.Targets) == 0 {
+					continue
+				}
+			}
+			rule = append(rule, shard)
+		}
+		if len(rule) == 0 {
+			t.apply(RoutingTreeUpdate{Deletes: []string{registration.Prefix}})
+		} else {
+			t.set(registration.Prefix, rule)
+		}
+	}
+}
+
+// withTarget returns a copy of targets including address, the rules of a
+// published table are shared and must not be modified in place
+func withTarget(targets Addresses, address Address) Addresses {
+	res := make(Addresses, len(targets), len(targets)+1)
+	copy(res, targets)
+	if !res.contains(address) {
+		res = append(res, address)
+	}
+	return res
+}
+
+func withoutTarget(targets Addresses, address Address) Addresses {
+	res := make(Addresses, 0, len(targets))
+	for _, target := range targets {
+		if target != address {
+			res = append(res, target)
+		}
+	}
+	return res
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoListener replies to the streams it receives with their contents
+type echoListener struct{}
+
+func (echoListener) OnStream(stream ReadStream) {
+	data, _ := ioutil.ReadAll(&stream)
+	stream.Reply(bytes.NewReader(data))
+}
+
+// silentListener never replies
+type silentListener struct{}
+
+func (silentListener) OnStream(stream ReadStream) {
+	ioutil.ReadAll(&stream)
+}
+
+// pipeClient connects a client of pid to factory over a pipe
+func pipeClient(t *testing.T, factory *LocalConnectionFactory, pid uint32, listener StreamListener) HyenaClient {
+	server, client := net.Pipe()
+	go factory.accept(server)
+	hc, err := newHyenaClient(client, pid, listener, ClientName("test"), FrameSizeLimit(MinFrameSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hc
+}
+
+func TestRequest(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{Services: map[string]Simple{
+		"s:/echo":   Simple{Targets: Addresses{Address{0, 2}}},
+		"s:/silent": Simple{Targets: Addresses{Address{0, 3}}},
+	}})
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), maxFrameSize: MaxFrameSize}
+	router := NewRouter(routing, factory)
+	defer router.Stop()
+	client := pipeClient(t, factory, 1, silentListener{})
+	pipeClient(t, factory, 2, echoListener{})
+	pipeClient(t, factory, 3, silentListener{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)
+	reply, err := client.Request(ctx, "s:/echo/1", strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, _ := ioutil.ReadAll(&reply)
+	if string(received) != data {
+		t.Errorf("Expected the echoed request, got %q", received)
+	}
+	headers, _ := reply.Headers()
+	if id, _, ok := repliedId(reply.Destination()); !ok || headers[HEADER_CORRELATION_ID] != id.String() {
+		t.Errorf("Expected a reply correlated to its request, got %v and %v", reply.Destination(), headers)
+	}
+	_, err = client.Request(ctx, "s:/nowhere", strings.NewReader(data))
+	if requestErr, ok := err.(*RequestError); !ok || requestErr.Destination != "s:/nowhere" {
+		t.Errorf("Expected a RequestError, got %v", err)
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	_, err = client.Request(short, "s:/silent", strings.NewReader(data))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+// forgingListener replies to the streams it receives without their reply-to
+// header, as a process guessing the reply destination of a request would
+type forgingListener struct{}
+
+func (forgingListener) OnStream(stream ReadStream) {
+	ioutil.ReadAll(&stream)
+	stream.client.StreamTo(ReplyDestination(stream.MessageId()).String(), strings.NewReader("Forged"))
+}
+
+// lateListener replies after delay
+type lateListener time.Duration
+
+func (l lateListener) OnStream(stream ReadStream) {
+	data, _ := ioutil.ReadAll(&stream)
+	time.Sleep(time.Duration(l))
+	stream.Reply(bytes.NewReader(data))
+}
+
+// proxyListener replies with the reply of the echo service, requested from
+// OnStream
+type proxyListener struct {
+	received chan string
+}
+
+func (p proxyListener) OnStream(stream ReadStream) {
+	p.received <- stream.Destination()
+	data, _ := ioutil.ReadAll(&stream)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := stream.client.Request(ctx, "s:/echo", bytes.NewReader(data))
+	if err != nil {
+		stream.Reply(strings.NewReader(err.Error()))
+		return
+	}
+	stream.Reply(&reply)
+}
+
+func TestRequestReplies(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{Services: map[string]Simple{
+		"s:/proxy":  Simple{Targets: Addresses{Address{0, 1}}},
+		"s:/echo":   Simple{Targets: Addresses{Address{0, 2}}},
+		"s:/forged": Simple{Targets: Addresses{Address{0, 3}}},
+		"s:/late":   Simple{Targets: Addresses{Address{0, 4}}},
+	}})
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), maxFrameSize: MaxFrameSize}
+	router := NewRouter(routing, factory)
+	defer router.Stop()
+	proxy := proxyListener{received: make(chan string, 16)}
+	client := pipeClient(t, factory, 1, proxy)
+	pipeClient(t, factory, 2, echoListener{})
+	pipeClient(t, factory, 3, forgingListener{})
+	pipeClient(t, factory, 4, lateListener(100*time.Millisecond))
+	requester := pipeClient(t, factory, 5, silentListener{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// The proxy requests the echo service from OnStream
+	reply, err := requester.Request(ctx, "s:/proxy", strings.NewReader("Lorel Ipsum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, _ := ioutil.ReadAll(&reply); string(received) != "Lorel Ipsum" {
+		t.Errorf("Expected the echo through the proxy, got %q", received)
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if _, err = client.Request(short, "s:/forged", strings.NewReader("Lorel Ipsum")); err != context.DeadlineExceeded {
+		t.Errorf("Expected the forged reply to be ignored, got %v", err)
+	}
+	late, cancelLate := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelLate()
+	if _, err = client.Request(late, "s:/late", strings.NewReader("Lorel Ipsum")); err != context.DeadlineExceeded {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	// The late reply is discarded and does not hold up the next ones
+	time.Sleep(200 * time.Millisecond)
+	reply, err = client.Request(ctx, "s:/echo", strings.NewReader("Dolor Sic Amet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, _ := ioutil.ReadAll(&reply); string(received) != "Dolor Sic Amet" {
+		t.Errorf("Expected the echoed request, got %q", received)
+	}
+	close(proxy.received)
+	for dest := range proxy.received {
+		if dest != "s:/proxy" {
+			t.Errorf("Expected only requests to reach OnStream, got %v", dest)
+		}
+	}
+}
+
+func TestParseMsgId(t *testing.T) {
+	id := CreateMid(1, 2, 3)
+	parsed, err := ParseMsgId(id.String())
+	if err != nil || parsed != id {
+		t.Errorf("Expected %v, got %v, %v", id, parsed, err)
+	}
+	if replied, _, ok := repliedId(ReplyDestination(id).String()); !ok || replied != id {
+		t.Errorf("Expected the reply destination of %v, got %v", id, replied)
+	}
+	if replied, token, ok := repliedId(replyDestination(id, "secret").String()); !ok || replied != id || token != "secret" {
+		t.Errorf("Expected the reply destination of %v with its token, got %v, %q", id, replied, token)
+	}
+	for _, invalid := range []string{"", "!", "AAAA"} {
+		if _, err := ParseMsgId(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"fmt"
+	"gopkg.in/tchap/go-patricia.v2/patricia"
+	"sort"
+)
+
+// Reshard replaces the ranges of the Sharded rule at Prefix covering From-To
+// by Ranges, which must cover the same keys: a range split in several, several
+// ranges merged in one, or ranges moved to new targets. Ranges may only leave
+// gaps where the replaced ranges did, bounds such as 7fff and 8000 are
+// contiguous when no key of their alphabet sorts between them.
+//
+// The change is a handover: new streams go to the new owners at once, while
+// streams in flight stay on the connection they started on until they end.
+type Reshard struct {
+	Prefix string  `json:"prefix"`
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Ranges Sharded `json:"ranges"`
+}
+
+// Handover is the result of a Reshard
+type Handover struct {
+	// Previous are the replaced ranges
+	Previous Sharded `json:"previous"`
+	// Current are the ranges of the rule after the reshard
+	Current Sharded `json:"current"`
+	// Streams are the streams still open on the previous ranges
+	Streams []StreamCount `json:"streams,omitempty"`
+}
+
+// Reshard applies reshard atomically and returns the replaced ranges and the
+// resulting ranges of the rule
+func (r *RoutingTree) Reshard(reshard Reshard) (Handover, error) {
+	var res Handover
+	var err error
+	r.update(func(t *routingTable) {
+		res, err = t.reshard(reshard)
+	})
+	return res, err
+}
+
+func (t *routingTable) reshard(reshard Reshard) (Handover, error) {
+	res := Handover{}
+	rule, ok := t.trie.Get(patricia.Prefix(reshard.Prefix)).(Sharded)
+	if !ok || t.reserved[reshard.Prefix] {
+		return res, fmt.Errorf("%v is not a sharded rule", reshard.Prefix)
+	}
+	if len(reshard.Ranges) == 0 {
+		return res, fmt.Errorf("%v: no ranges to reshard to", reshard.Prefix)
+	}
+	startFound, endFound := false, false
+	current := make(Sharded, 0, len(rule)+len(reshard.Ranges))
+	for _, shard := range rule {
+		inside := shard.From >= reshard.From && shard.To <= reshard.To
+		outside := shard.To < reshard.From || shard.From > reshard.To
+		switch {
+		case inside:
+			res.Previous = append(res.Previous, shard)
+			startFound = startFound || shard.From == reshard.From
+			endFound = endFound || shard.To == reshard.To
+		case outside:
+			current = append(current, shard)
+		default:
+			return res, fmt.Errorf("%v[%v-%v] crosses the bounds of %v[%v-%v]", reshard.Prefix, shard.From, shard.To, reshard.Prefix, reshard.From, reshard.To)
+		}
+	}
+	if !startFound || !endFound {
+		return res, fmt.Errorf("%v[%v-%v] does not start and end on range bounds", reshard.Prefix, reshard.From, reshard.To)
+	}
+	ranges := make(Sharded, len(reshard.Ranges))
+	copy(ranges, reshard.Ranges)
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].From < ranges[j].From
+	})
+	if ranges[0].From != reshard.From || ranges[len(ranges)-1].To != reshard.To {
+		return res, fmt.Errorf("%v: ranges must cover %v-%v", reshard.Prefix, reshard.From, reshard.To)
+	}
+	alphabet := keyAlphabet(append(ranges, res.Previous...))
+	for i := 1; i < len(ranges); i++ {
+		previous, next := ranges[i-1], ranges[i]
+		if next.From <= previous.To {
+			return res, fmt.Errorf("%v: ranges %v-%v and %v-%v overlap", reshard.Prefix, previous.From, previous.To, next.From, next.To)
+		}
+		if !adjacentKeys(alphabet, previous.To, next.From) && !isGap(res.Previous, previous.To, next.From) {
+			return res, fmt.Errorf("%v: ranges %v-%v and %v-%v are not contiguous", reshard.Prefix, previous.From, previous.To, next.From, next.To)
+		}
+	}
+	current = append(current, ranges...)
+	sort.SliceStable(current, func(i, j int) bool {
+		return current[i].From < current[j].From
+	})
+	update := RoutingTreeUpdate{Shards: map[string]Sharded{reshard.Prefix: current}}
+	if err := update.Validate().Err(); err != nil {
+		return res, err
+	}
+	t.apply(update)
+	res.Current = current
+	return res, nil
+}
+
+// isGap returns true if no key between after and before, both excluded, is
+// routed by shards
+func isGap(shards Sharded, after string, before string) bool {
+	for _, shard := range shards {
+		if shard.From < before && shard.To > after {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func shardedTree() *RoutingTree {
+	routing := NewRoutingTree()
+	routing.UpsertShardedRule("s:/users/", Sharded{
+		ShardEntry{From: "00", To: "49", Targets: Addresses{Address{0, 1}}},
+		ShardEntry{From: "50", To: "99", Targets: Addresses{Address{0, 2}}},
+	})
+	return routing
+}
+
+func TestRoutingTreeReshard(t *testing.T) {
+	routing := shardedTree()
+	// Split 50-99 and move its upper half
+	handover, err := routing.Reshard(Reshard{Prefix: "s:/users/", From: "50", To: "99", Ranges: Sharded{
+		ShardEntry{From: "50", To: "74", Targets: Addresses{Address{0, 2}}},
+		ShardEntry{From: "75", To: "99", Targets: Addresses{Address{0, 3}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handover.Previous) != 1 || len(handover.Current) != 3 {
+		t.Errorf("Unexpected handover %+v", handover)
+	}
+	check("s:/users/60", Addresses{Address{0, 2}}, routing, t)
+	check("s:/users/80", Addresses{Address{0, 3}}, routing, t)
+	// Merge everything on one target
+	_, err = routing.Reshard(Reshard{Prefix: "s:/users/", From: "00", To: "99", Ranges: Sharded{
+		ShardEntry{From: "00", To: "99", Targets: Addresses{Address{0, 4}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("s:/users/10", Addresses{Address{0, 4}}, routing, t)
+	check("s:/users/80", Addresses{Address{0, 4}}, routing, t)
+	for _, reshard := range []Reshard{
+		{Prefix: "s:/unknown/", From: "00", To: "99", Ranges: Sharded{ShardEntry{From: "00", To: "99", Targets: Addresses{Address{0, 1}}}}},
+		{Prefix: "s:/users/", From: "00", To: "49", Ranges: Sharded{ShardEntry{From: "00", To: "49", Targets: Addresses{Address{0, 1}}}}},
+		{Prefix: "s:/users/", From: "00", To: "99", Ranges: Sharded{ShardEntry{From: "00", To: "98", Targets: Addresses{Address{0, 1}}}}},
+		{Prefix: "s:/users/", From: "00", To: "99", Ranges: Sharded{
+			ShardEntry{From: "00", To: "49", Targets: Addresses{Address{0, 1}}},
+			ShardEntry{From: "51", To: "99", Targets: Addresses{Address{0, 1}}},
+		}},
+		{Prefix: "s:/users/", From: "00", To: "99", Ranges: Sharded{ShardEntry{From: "00", To: "99"}}},
+	} {
+		if _, err := routing.Reshard(reshard); err == nil {
+			t.Errorf("Expected %+v to be rejected", reshard)
+		}
+	}
+	check("s:/users/80", Addresses{Address{0, 4}}, routing, t)
+}
+
+func TestRoutingTreeReshardHex(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.UpsertShardedRule("s:/blobs/", Sharded{
+		ShardEntry{From: "0000", To: "3fff", Targets: Addresses{Address{0, 1}}},
+		ShardEntry{From: "5000", To: "ffff", Targets: Addresses{Address{0, 2}}},
+	})
+	_, err := routing.Reshard(Reshard{Prefix: "s:/blobs/", From: "5000", To: "ffff", Ranges: Sharded{
+		ShardEntry{From: "5000", To: "7fff", Targets: Addresses{Address{0, 2}}},
+		ShardEntry{From: "8000", To: "ffff", Targets: Addresses{Address{0, 3}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("s:/blobs/7abc", Addresses{Address{0, 2}}, routing, t)
+	check("s:/blobs/8abc", Addresses{Address{0, 3}}, routing, t)
+	// The gap 4000-4fff of the replaced ranges may stay
+	_, err = routing.Reshard(Reshard{Prefix: "s:/blobs/", From: "0000", To: "7fff", Ranges: Sharded{
+		ShardEntry{From: "0000", To: "3fff", Targets: Addresses{Address{0, 4}}},
+		ShardEntry{From: "5000", To: "7fff", Targets: Addresses{Address{0, 4}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = routing.Reshard(Reshard{Prefix: "s:/blobs/", From: "8000", To: "ffff", Ranges: Sharded{
+		ShardEntry{From: "8000", To: "9fff", Targets: Addresses{Address{0, 4}}},
+		ShardEntry{From: "b000", To: "ffff", Targets: Addresses{Address{0, 4}}},
+	}})
+	if err == nil {
+		t.Error("Expected a new gap to be rejected")
+	}
+	snapshot := routing.Snapshot()
+	if validation := snapshot.Validate(); len(validation.Warnings) != 1 {
+		t.Errorf("Expected only the gap after 0000-3fff, got %v", validation.Warnings)
+	}
+}
+
+func TestRouterHandover(t *testing.T) {
+	previous := &countingConnection{ok: true}
+	next := &countingConnection{ok: true}
+	routing := shardedTree()
+	router := NewRouter(routing, countingConnectionFactory{Address{0, 2}: previous, Address{0, 3}: next})
+	frames := make(chan *Frame, 16)
+	stream := NewWriteStream(CreateMid(0, 0, 1), MustParseDestination("s:/users/80"), frames)
+	stream.SetFrameSize(MinFrameSize)
+	stream.Write([]byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)))
+	stream.Close()
+	close(frames)
+	router.Recv() <- <-frames
+	time.Sleep(50 * time.Millisecond)
+	open := router.OpenStreams("s:/users/")
+	if len(open) != 1 || open[0].Rule != "s:/users/[50]" || open[0].Address != (Address{0, 2}) {
+		t.Errorf("Expected a stream open on 0.2, got %v", open)
+	}
+	_, err := routing.Reshard(Reshard{Prefix: "s:/users/", From: "50", To: "99", Ranges: Sharded{
+		ShardEntry{From: "50", To: "99", Targets: Addresses{Address{0, 3}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream in flight finishes on its owner, new streams go to the new one
+	for f := range frames {
+		router.Recv() <- f
+	}
+	sendStream(router, CreateMid(0, 0, 2), "s:/users/80", []byte("Lorel Ipsum"))
+	time.Sleep(50 * time.Millisecond)
+	router.Stop()
+	if previous.count() != 3 || next.count() != 1 {
+		t.Errorf("Expected 3 frames on the previous owner and 1 on the new one, got %v and %v", previous.count(), next.count())
+	}
+	if open := router.OpenStreams(""); len(open) != 0 {
+		t.Errorf("Expected no stream open, got %v", open)
+	}
+}
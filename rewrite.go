@@ -0,0 +1,124 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"fmt"
+	"gopkg.in/tchap/go-patricia.v2/patricia"
+	"strings"
+)
+
+// Rewrite rules map a source prefix to a new prefix: a destination starting
+// with the source is routed as if it started with the new prefix instead.
+// The longest matching source wins, rewritten destinations are rewritten
+// again until no source matches, a source met twice is a loop and the
+// destination is unroutable.
+
+// rewrite returns destination after the rewrite rules of the table
+func (t *routingTable) rewrite(destination string, explanation *Explanation) (string, error) {
+	seen := make(map[string]bool)
+	for {
+		source := ""
+		found := false
+		t.rewriteTrie.VisitPrefixes(patricia.Prefix(destination), func(key patricia.Prefix, item patricia.Item) error {
+			// VisitPrefixes goes from the shortest to the longest prefix
+			source = string(key)
+			found = true
+			return nil
+		})
+		if !found {
+			return destination, nil
+		}
+		if seen[source] {
+			return destination, fmt.Errorf("Rewrite loop on %v", source)
+		}
+		seen[source] = true
+		destination = t.rewrites[source] + destination[len(source):]
+		if explanation != nil {
+			explanation.Rewrites = append(explanation.Rewrites, destination)
+		}
+	}
+}
+
+func (t *routingTable) setRewrite(source string, target string) {
+	if t.reservedOverlap(source) {
+		return
+	}
+	t.rewriteTrie.Set(patricia.Prefix(source), target)
+	t.rewrites[source] = target
+}
+
+func (t *routingTable) deleteRewrite(source string) {
+	if _, ok := t.rewrites[source]; ok {
+		t.rewriteTrie.Delete(patricia.Prefix(source))
+		delete(t.rewrites, source)
+	}
+}
+
+// reservedOverlap returns true if rewriting source could capture destinations
+// of a reserved prefix
+func (t *routingTable) reservedOverlap(source string) bool {
+	for prefix := range t.reserved {
+		if strings.HasPrefix(prefix, source) || strings.HasPrefix(source, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRewrites(v *Validation, u *RoutingTreeUpdate) {
+	for _, source := range sortedKeys(u.Rewrites) {
+		target := u.Rewrites[source]
+		if isPattern(source) || isPattern(target) {
+			v.errorf("%v: wildcards are not supported in rewrites", source)
+		}
+		if target == "" {
+			v.errorf("%v: empty rewrite target", source)
+		}
+		_, isService := u.Services[source]
+		_, isShard := u.Shards[source]
+		_, isHashShard := u.HashShards[source]
+		if isService || isShard || isHashShard {
+			v.warnf("%v: rule shadowed by a rewrite", source)
+		}
+		if loop := rewriteLoop(u.Rewrites, source); loop != "" {
+			v.errorf("%v: rewrite loop through %v", source, loop)
+		}
+	}
+}
+
+// rewriteLoop returns the source met twice rewriting source with rewrites,
+// or an empty string if there is no loop
+func rewriteLoop(rewrites map[string]string, source string) string {
+	seen := make(map[string]bool)
+	destination := source
+	for {
+		longest := ""
+		for candidate := range rewrites {
+			if strings.HasPrefix(destination, candidate) && len(candidate) > len(longest) {
+				longest = candidate
+			}
+		}
+		if longest == "" {
+			return ""
+		}
+		if seen[longest] {
+			return longest
+		}
+		seen[longest] = true
+		destination = rewrites[longest] + destination[len(longest):]
+	}
+}
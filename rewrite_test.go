@@ -0,0 +1,153 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutingTreeRewrites(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/invoicing": Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/billing":   Simple{Targets: Addresses{Address{0, 2}}},
+		},
+		Rewrites: map[string]string{
+			"s:/billing":        "s:/invoicing",
+			"s:/billing/legacy": "s:/old/billing",
+			"s:/old":            "s:/invoicing/old",
+			"s:/ping":           "s:/pong",
+			"s:/pong":           "s:/ping",
+		},
+	})
+	check("s:/billing/42", Addresses{Address{0, 1}}, routing, t)
+	check("s:/billing/legacy/42", Addresses{Address{0, 1}}, routing, t)
+	if route := routing.Route(MustParseDestination("s:/billing/42")); route.Destination != "s:/invoicing/42" {
+		t.Errorf("Expected rewritten destination, got %+v", route)
+	}
+	if route := routing.Route(MustParseDestination("s:/invoicing/42")); route.Destination != "" {
+		t.Errorf("Expected no rewrite, got %+v", route)
+	}
+	if route := routing.Route(MustParseDestination("s:/ping/1")); route.Error == "" || len(route.Addresses) != 0 {
+		t.Errorf("Expected a rewrite loop, got %+v", route)
+	}
+	explanation := routing.Explain("s:/billing/legacy/42")
+	expected := []string{"s:/old/billing/42", "s:/invoicing/old/billing/42"}
+	if !reflect.DeepEqual(explanation.Rewrites, expected) {
+		t.Errorf("Expected rewrites %v, got %v", expected, explanation.Rewrites)
+	}
+	// Rewrites can not capture reserved prefixes
+	routing.Reserve("h:/routing", Simple{Targets: Addresses{DAEMON_ADDRESS}})
+	update := RoutingTreeUpdate{Rewrites: map[string]string{"h:/": "s:/"}}
+	if reserved := routing.Reserved(update); len(reserved) != 1 {
+		t.Errorf("Expected h:/ to be reserved, got %v", reserved)
+	}
+	routing.Apply(update)
+	check("h:/routing", Addresses{DAEMON_ADDRESS}, routing, t)
+	update = routing.Diff(RoutingTreeUpdate{
+		Services: routing.Snapshot().Services,
+		Rewrites: map[string]string{"s:/billing": "s:/invoicing"},
+	})
+	if !reflect.DeepEqual(update.Deletes, []string{"s:/billing/legacy", "s:/old", "s:/ping", "s:/pong"}) || len(update.Rewrites) != 0 {
+		t.Errorf("Unexpected rewrite diff %+v", update)
+	}
+	routing.Apply(update)
+	check("s:/billing/legacy/42", Addresses{Address{0, 1}}, routing, t)
+	check("s:/old/1", Addresses{}, routing, t)
+}
+
+func TestRewritesValidate(t *testing.T) {
+	update := RoutingTreeUpdate{
+		Services: map[string]Simple{"s:/a": Simple{Targets: Addresses{Address{0, 1}}}},
+		Rewrites: map[string]string{
+			"s:/a":    "s:/b",
+			"s:/b":    "s:/c/x",
+			"s:/c":    "s:/a",
+			"s:/d":    "",
+			"s:/e/*":  "s:/f",
+			"s:/fine": "s:/a",
+		},
+	}
+	validation := update.Validate()
+	expected := Validation{
+		Errors: []string{
+			`s:/a: rewrite loop through s:/a`,
+			`s:/b: rewrite loop through s:/b`,
+			`s:/c: rewrite loop through s:/c`,
+			`s:/d: empty rewrite target`,
+			`s:/e/*: wildcards are not supported in rewrites`,
+			`s:/fine: rewrite loop through s:/a`,
+		},
+		Warnings: []string{`s:/a: rule shadowed by a rewrite`},
+	}
+	if !reflect.DeepEqual(validation, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, validation)
+	}
+}
+
+func TestRouterRewrite(t *testing.T) {
+	invoicing := &collectingConnection{}
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{"s:/invoicing": Simple{Targets: Addresses{Address{0, 1}}}},
+		Rewrites: map[string]string{"s:/billing": "s:/invoicing"},
+	})
+	router := NewRouter(routing, mapConnectionFactory{Address{0, 1}: invoicing})
+	data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 5000)
+	sendSizedStream(router, CreateMid(0, 0, 1), "s:/billing/42", []byte(data), MaxFrameSize)
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if invoicing.String() != data {
+		t.Errorf("Expected the stream on the rewritten destination, got %q", invoicing.String())
+	}
+	if dests := invoicing.destinations(); !reflect.DeepEqual(dests, []string{"s:/invoicing/42"}) {
+		t.Errorf("Expected first frame to be sent to s:/invoicing/42, got %v", dests)
+	}
+	// The longer destination pushed contents to an extra frame
+	for i, number := range invoicing.numbers {
+		if number != uint64(i) {
+			t.Errorf("Expected frames numbered in sequence, got %v", invoicing.numbers)
+			break
+		}
+	}
+	if len(invoicing.numbers) != 4 {
+		t.Errorf("Expected 4 frames, got %v", invoicing.numbers)
+	}
+}
+
+func TestRouterDeadLetterRewritten(t *testing.T) {
+	deadLetter := "s:/dead"
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Rewrites:   map[string]string{"s:/dead": "s:/nowhere"},
+		DeadLetter: &deadLetter,
+	})
+	router := NewRouter(routing, mapConnectionFactory{})
+	sendStream(router, CreateMid(0, 0, 1), "s:/test", []byte("Lorel Ipsum"))
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if metrics := router.Metrics(); metrics.DeadLettered != 1 || metrics.DroppedStreams != 1 {
+		t.Errorf("Expected the unroutable dead letter dropped, got %+v", metrics)
+	}
+	update := RoutingTreeUpdate{Rewrites: map[string]string{"s:/dead": "s:/nowhere"}, DeadLetter: &deadLetter}
+	if validation := update.Validate(); len(validation.Errors) != 1 || !strings.Contains(validation.Errors[0], "deadLetter") {
+		t.Errorf("Expected a rewritten dead letter rejected, got %v", validation)
+	}
+}
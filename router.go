@@ -16,7 +16,14 @@ limitations under the License.
 package hyenad
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Router struct {
@@ -24,6 +31,80 @@ type Router struct {
 	recv      chan *Frame
 	closeChan chan struct{}
 	factory   ConnectionFactory
+	balancer  *balancer
+	metrics   *RouterMetrics
+	open      *openStreams
+	breakers  *breakers
+	// localNode is the node of the router when preferLocal is set
+	localNode   uint32
+	preferLocal bool
+}
+
+// RouterOption configures a Router created by NewRouter
+type RouterOption func(r *Router)
+
+// LocalNode sets the node id of the router, new streams go to targets on the
+// local node and only fall back to remote targets when no local one is live.
+func LocalNode(nid uint32) RouterOption {
+	return func(r *Router) {
+		r.localNode = nid
+		r.preferLocal = true
+	}
+}
+
+// RouterMetrics counts the streams the router could not deliver or that were
+// aborted, and the transitions of the circuits of its targets
+type RouterMetrics struct {
+	// DeadLettered is the number of streams sent to a dead-letter destination
+	DeadLettered uint64
+	// DroppedStreams is the number of unroutable streams discarded
+	DroppedStreams uint64
+	// DroppedFrames is the number of continuation frames of discarded streams
+	DroppedFrames uint64
+	// SendFailures is the number of failed sends, closed connections included
+	SendFailures uint64
+	// CircuitsOpened and CircuitsClosed count the circuit transitions
+	CircuitsOpened uint64
+	CircuitsClosed uint64
+	// OpenCircuits is the number of open or half-open circuits
+	OpenCircuits int
+	// AbortedStreams is the number of streams aborted by their writer
+	AbortedStreams uint64
+	// AbortedTargets is the number of streams aborted on a target after a
+	// failed send
+	AbortedTargets uint64
+}
+
+// DeadLetter heads a stream sent to a dead-letter destination, it is written
+// as a JSON line before the contents of the unroutable stream.
+type DeadLetter struct {
+	Id          string `json:"id"`
+	Destination string `json:"destination"`
+	Reason      string `json:"reason"`
+	// Headers are the headers of the unroutable stream, when they fit in its
+	// first frame. The header block is not part of the copied contents.
+	Headers Headers `json:"headers,omitempty"`
+}
+
+// streams is the state of the streams in flight, owned by Router.run
+type streams struct {
+	connections map[MsgId][]Connection
+	// addresses are the addresses of the connections of the open streams
+	addresses map[MsgId]Addresses
+	// owners are the rule and targets of the open streams
+	owners      map[MsgId][]streamOwner
+	deadLetters map[MsgId]*WriteStream
+	// skipped are the bytes of header blocks left to skip in the contents
+	// of dead-lettered streams
+	skipped map[MsgId]int
+	dropped map[MsgId]bool
+	// offsets are added to the frame numbers of rewritten streams that
+	// gained frames
+	offsets map[MsgId]uint64
+	// pending receives the frames of dead-letter streams, each contents frame
+	// of an unroutable stream produces at most a few of them and they are
+	// routed right away
+	pending chan *Frame
 }
 
 type ConnectionFactory interface {
@@ -31,28 +112,262 @@ type ConnectionFactory interface {
 	Get(address Address, recv chan<- *Frame) (Connection, error)
 }
 
-func NewRouter(routing Routing, factory ConnectionFactory) Router {
+func NewRouter(routing Routing, factory ConnectionFactory, opts ...RouterOption) Router {
 	InitFrameBuffers()
 	res := Router{}
 	res.routing = routing
 	res.factory = factory
 	res.recv = make(chan *Frame, 64)
 	res.closeChan = make(chan struct{})
+	res.balancer = newBalancer()
+	res.metrics = &RouterMetrics{}
+	res.open = &openStreams{counts: make(map[streamOwner]int)}
+	res.breakers = newBreakers(res.metrics)
+	for _, opt := range opts {
+		opt(&res)
+	}
 	res.factory.SetRouter(res)
 	go res.run()
 	return res
 }
 
-func bestAddress(addresses Addresses) Address {
-	if len(addresses) == 0 {
-		return INVALID_ADDRESS
-	} else {
-		return addresses[0]
+// liveConnection returns the connection to address if it is Ok and the
+// circuit of address lets new streams through
+func (r *Router) liveConnection(address Address) (Connection, error) {
+	conn, err := r.factory.Get(address, r.recv)
+	if err != nil {
+		return nil, err
+	}
+	if !conn.Ok() {
+		err = fmt.Errorf("Connection to %v closed", address)
+		r.breakers.failure(address, err)
+		return nil, err
+	}
+	if err := r.breakers.allow(address, conn); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// isLocal returns true if address is on the local node, every address is
+// local when the router has no local node
+func (r *Router) isLocal(address Address) bool {
+	return !r.preferLocal || address.Node == r.localNode
+}
+
+// localFirst moves the local targets of addresses before the remote ones,
+// keeping the balancing order within each group
+func (r *Router) localFirst(addresses Addresses) Addresses {
+	if !r.preferLocal {
+		return addresses
+	}
+	res := make(Addresses, 0, len(addresses))
+	for _, address := range addresses {
+		if r.isLocal(address) {
+			res = append(res, address)
+		}
+	}
+	for _, address := range addresses {
+		if !r.isLocal(address) {
+			res = append(res, address)
+		}
+	}
+	return res
+}
+
+// selectConnection returns a connection to the preferred live target of route
+// for a new stream to destination, and the address of the target, skipping
+// targets without a connection or whose connection is not Ok. Remote targets
+// are only used when no local target is live.
+func (r *Router) selectConnection(route Route, destination string) (Connection, Address, error) {
+	addresses := r.localFirst(r.balancer.order(route, destination))
+	var best Connection
+	var bestAddress Address
+	for _, address := range addresses {
+		if best != nil && !r.isLocal(address) {
+			break
+		}
+		conn, err := r.liveConnection(address)
+		if err != nil {
+			if debug {
+				log.WithField("Address", address).WithError(err).Debug("Skipping target")
+			}
+			continue
+		}
+		if route.Policy != LEAST_QUEUED {
+			return conn, address, nil
+		}
+		if best == nil || conn.Queue() < best.Queue() {
+			best = conn
+			bestAddress = address
+		}
+	}
+	if best != nil {
+		return best, bestAddress, nil
+	}
+	return nil, INVALID_ADDRESS, fmt.Errorf("No live target in %v", route.Addresses)
+}
+
+// selectConnections returns the connections a new stream is sent to and
+// their addresses: every live target of a broadcast route, or the selected
+// one.
+func (r *Router) selectConnections(route Route, destination string) ([]Connection, Addresses, error) {
+	if !route.Broadcast {
+		conn, address, err := r.selectConnection(route, destination)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []Connection{conn}, Addresses{address}, nil
+	}
+	var res []Connection
+	var addresses Addresses
+	for _, address := range route.Addresses {
+		conn, err := r.liveConnection(address)
+		if err == nil {
+			res = append(res, conn)
+			addresses = append(addresses, address)
+		} else if debug {
+			log.WithField("Address", address).WithError(err).Debug("Skipping broadcast target")
+		}
+	}
+	if len(res) == 0 {
+		return nil, nil, fmt.Errorf("No live target in %v", route.Addresses)
+	}
+	return res, addresses, nil
+}
+
+// send sends f to every connection of conns, sharing its buffer between them,
+// and records the outcome in the circuits of their addresses. It returns the
+// error of every send, nil when it succeeded.
+func (r *Router) send(f *Frame, conns []Connection, addresses Addresses) []error {
+	description := f.String()
+	errs := make([]error, len(conns))
+	f.retain(len(conns) - 1)
+	for i, conn := range conns {
+		if err := conn.Send(f); err != nil {
+			log.WithField("Address", addresses[i]).WithField("Frame", description).WithError(err).Warn("Sending frame failed")
+			r.breakers.failure(addresses[i], err)
+			errs[i] = err
+		} else {
+			r.breakers.success(addresses[i])
+		}
+	}
+	return errs
+}
+
+// dropFailed removes from stream id the targets frame number could not be
+// sent to, they get an abort frame when they received the start of the
+// stream. Streams left without target are dropped and their writer told.
+func (r *Router) dropFailed(s *streams, id MsgId, number uint64, last bool, conns []Connection, addresses Addresses, errs []error) {
+	owners := s.owners[id]
+	var kept []Connection
+	var keptAddresses Addresses
+	var keptOwners, removedOwners []streamOwner
+	failed := false
+	for i, err := range errs {
+		if err == nil {
+			kept = append(kept, conns[i])
+			keptAddresses = append(keptAddresses, addresses[i])
+			if i < len(owners) {
+				keptOwners = append(keptOwners, owners[i])
+			}
+			continue
+		}
+		failed = true
+		if i < len(owners) {
+			removedOwners = append(removedOwners, owners[i])
+		}
+		if number > 0 {
+			r.abortTarget(conns[i], addresses[i], id, number, err)
+		}
+	}
+	if !failed || last {
+		return
+	}
+	r.open.remove(removedOwners)
+	if len(kept) == 0 {
+		delete(s.connections, id)
+		delete(s.addresses, id)
+		delete(s.owners, id)
+		s.dropped[id] = true
+		for _, err := range errs {
+			if err != nil {
+				r.abortWriter(id, err)
+				break
+			}
+		}
+		return
+	}
+	s.connections[id] = kept
+	s.addresses[id] = keptAddresses
+	s.owners[id] = keptOwners
+}
+
+// abortTarget sends the abort frame number of stream id to conn, its frames
+// stop at the failed send of reason
+func (r *Router) abortTarget(conn Connection, address Address, id MsgId, number uint64, reason error) {
+	atomic.AddUint64(&r.metrics.AbortedTargets, 1)
+	f, err := NewFrame(FrameHeader{Id: id, FrameNumber: number, Flags: LASTFRAME | ABORT}, []byte(fmt.Sprintf("Sending to %v failed: %v", address, reason)))
+	if err == nil {
+		err = conn.Send(&f)
+	}
+	if err != nil {
+		log.WithField("Address", address).WithField("Id", id).WithError(err).Warn("Aborting stream on target failed")
+	}
+}
+
+// throttle stops reading from the writer of stream id while one of conns,
+// the targets of the stream, has LOCAL_SEND_QUEUE frames queued
+func (r *Router) throttle(id MsgId, conns []Connection) {
+	for _, conn := range conns {
+		if conn.Queue() < LOCAL_SEND_QUEUE {
+			continue
+		}
+		nid, pid, _ := id.Split()
+		if pid == DAEMON_PID {
+			return
+		}
+		writer, err := r.factory.Get(Address{nid, pid}, r.recv)
+		if err != nil {
+			return
+		}
+		if t, ok := writer.(throttler); ok {
+			t.throttle(conn)
+		}
+	}
+}
+
+// abortWriter tells the writer of stream id that the stream was dropped for
+// reason, its next writes fail
+func (r *Router) abortWriter(id MsgId, reason error) {
+	nid, pid, _ := id.Split()
+	if pid == DAEMON_PID {
+		return
+	}
+	writer, err := r.factory.Get(Address{nid, pid}, r.recv)
+	if err == nil {
+		var f Frame
+		f, err = NewFrame(FrameHeader{Id: id, Flags: LASTFRAME | ABORT}, []byte(fmt.Sprintf("Stream dropped: %v", reason)))
+		if err == nil {
+			err = writer.Send(&f)
+		}
+	}
+	if err != nil {
+		log.WithField("Id", id).WithError(err).Warn("Telling the writer of a dropped stream failed")
 	}
 }
 
 func (r *Router) run() {
-	connections := make(map[MsgId]Connection)
+	s := &streams{
+		connections: make(map[MsgId][]Connection),
+		addresses:   make(map[MsgId]Addresses),
+		owners:      make(map[MsgId][]streamOwner),
+		deadLetters: make(map[MsgId]*WriteStream),
+		skipped:     make(map[MsgId]int),
+		dropped:     make(map[MsgId]bool),
+		offsets:     make(map[MsgId]uint64),
+		pending:     make(chan *Frame, 64),
+	}
 	if debug {
 		log.WithField("Router", r).Debug("Listening for frames")
 	}
@@ -61,31 +376,11 @@ stop:
 		select {
 		case f := <-r.recv:
 			{
-				if f.FrameNumber == 0 {
-					addresses := r.routing.Route(f.Dest)
-					address := bestAddress(addresses)
-					conn, err := r.factory.Get(address, r.recv)
-					if err == nil {
-						conn.Send(f)
-						if !f.Flags.Is(LASTFRAME) {
-							connections[f.Id] = conn
-						}
-					} else {
-						log.WithField("Frame", f.String()).WithField("Destination", f.Dest).Error("No connection found for destination")
-						frameBuffers.Return(f.buffer)
-					}
-				} else {
-					conn, ok := connections[f.Id]
-					if ok {
-						conn.Send(f)
-						if f.Flags.Is(LASTFRAME) {
-							delete(connections, f.Id)
-						}
-					} else {
-						log.WithField("Frame", f.String()).Error("No active connection found for FrameId")
-						frameBuffers.Return(f.buffer)
-					}
+				if f.Flags.Is(ABORT) {
+					log.WithField("Frame", f.String()).WithField("Reason", string(f.Contents())).Info("Stream aborted")
+					atomic.AddUint64(&r.metrics.AbortedStreams, 1)
 				}
+				r.route(s, f)
 			}
 		case _ = <-r.closeChan:
 			{
@@ -95,6 +390,285 @@ stop:
 	}
 }
 
+func (r *Router) route(s *streams, f *Frame) {
+	if f.FrameNumber == 0 {
+		destination, err := ParseDestination(f.Dest)
+		if err != nil {
+			r.unroutable(s, f, Route{}, err)
+			return
+		}
+		route := r.routing.Route(destination)
+		if route.Error != "" {
+			r.unroutable(s, f, route, errors.New(route.Error))
+			return
+		}
+		frames := []*Frame{f}
+		if route.Destination != "" && route.Destination != f.Dest {
+			var err error
+			frames, err = f.redirect(route.Destination)
+			if err != nil {
+				r.unroutable(s, f, route, fmt.Errorf("Rewriting to %v: %v", route.Destination, err))
+				return
+			}
+			if debug {
+				log.WithField("Destination", f.Dest).WithField("Rewritten", route.Destination).Debug("Rewrote destination")
+			}
+			f = frames[0]
+		}
+		open := !frames[len(frames)-1].Flags.Is(LASTFRAME)
+		var conns []Connection
+		var addresses Addresses
+		conns, addresses, err = r.selectConnections(route, f.Dest)
+		if err == nil {
+			id, last := f.Id, f.Flags.Is(LASTFRAME)
+			errs := r.send(f, conns, addresses)
+			if !last {
+				s.connections[id] = conns
+				s.addresses[id] = addresses
+				s.owners[id] = r.open.add(route.Rule, addresses)
+				r.throttle(id, conns)
+			}
+			r.dropFailed(s, id, 0, last, conns, addresses, errs)
+		} else {
+			r.unroutable(s, f, route, err)
+		}
+		for _, next := range frames[1:] {
+			r.route(s, next)
+		}
+		if len(frames) > 1 && open {
+			// The stream gained frames, shift the following ones
+			s.offsets[f.Id] = uint64(len(frames) - 1)
+		}
+		return
+	}
+	if offset, ok := s.offsets[f.Id]; ok {
+		f.renumber(f.FrameNumber + offset)
+		if f.Flags.Is(LASTFRAME) {
+			delete(s.offsets, f.Id)
+		}
+	}
+	if conns, ok := s.connections[f.Id]; ok {
+		id, number, last := f.Id, f.FrameNumber, f.Flags.Is(LASTFRAME)
+		addresses := s.addresses[id]
+		errs := r.send(f, conns, addresses)
+		if last {
+			delete(s.connections, id)
+			delete(s.addresses, id)
+			r.open.remove(s.owners[id])
+			delete(s.owners, id)
+		} else {
+			r.throttle(id, conns)
+		}
+		r.dropFailed(s, id, number, last, conns, addresses, errs)
+	} else if deadLetter, ok := s.deadLetters[f.Id]; ok {
+		r.deadLetter(s, deadLetter, f)
+		if f.Flags.Is(LASTFRAME) {
+			delete(s.deadLetters, f.Id)
+			delete(s.skipped, f.Id)
+		}
+		f.Release()
+	} else if s.dropped[f.Id] {
+		atomic.AddUint64(&r.metrics.DroppedFrames, 1)
+		if f.Flags.Is(LASTFRAME) {
+			delete(s.dropped, f.Id)
+		}
+		f.Release()
+	} else {
+		log.WithField("Frame", f.String()).Error("No active connection found for FrameId")
+		f.Release()
+	}
+}
+
+// unroutable sends the stream of the first frame f to the dead-letter
+// destination of route, or drops it when there is none. Streams sent to the
+// dead-letter destination itself and streams of hyenad, dead letters
+// included, are always dropped, the writer of a dropped stream is told.
+func (r *Router) unroutable(s *streams, f *Frame, route Route, reason error) {
+	last := f.Flags.Is(LASTFRAME)
+	r.replyError(s, f, reason)
+	_, pid, _ := f.Id.Split()
+	if route.DeadLetter == "" || f.Dest == route.DeadLetter || pid == DAEMON_PID {
+		log.WithField("Frame", f.String()).WithField("Destination", f.Dest).WithError(reason).Error("No connection found for destination")
+		atomic.AddUint64(&r.metrics.DroppedStreams, 1)
+		if !last {
+			s.dropped[f.Id] = true
+			r.abortWriter(f.Id, reason)
+		}
+		f.Release()
+		return
+	}
+	destination, err := ParseDestination(route.DeadLetter)
+	if err != nil {
+		log.WithField("Frame", f.String()).WithField("Destination", f.Dest).WithError(reason).WithField("DeadLetterError", err).Error("No connection found for destination")
+		atomic.AddUint64(&r.metrics.DroppedStreams, 1)
+		if !last {
+			s.dropped[f.Id] = true
+			r.abortWriter(f.Id, reason)
+		}
+		f.Release()
+		return
+	}
+	log.WithField("Frame", f.String()).WithField("Destination", f.Dest).WithField("DeadLetter", route.DeadLetter).WithError(reason).Warn("Sending unroutable stream to dead-letter destination")
+	atomic.AddUint64(&r.metrics.DeadLettered, 1)
+	deadLetter := NewWriteStream(newDaemonMsgId(), destination, s.pending)
+	record := DeadLetter{Id: f.Id.String(), Destination: f.Dest, Reason: reason.Error()}
+	if f.Flags.Is(HEADERS) {
+		record.Headers, _ = f.Headers()
+		size, err := headerBlockSize(f.Contents())
+		if err != nil {
+			log.WithField("Frame", f.String()).WithError(err).Warn("Dead letter keeps the header block of the stream")
+		}
+		s.skipped[f.Id] = size
+	}
+	header, _ := json.Marshal(record)
+	deadLetter.Write(append(header, '\n'))
+	r.deadLetter(s, deadLetter, f)
+	if !last {
+		s.deadLetters[f.Id] = deadLetter
+	} else {
+		delete(s.skipped, f.Id)
+	}
+	f.Release()
+}
+
+// deadLetter copies the contents of f to the dead-letter stream, after the
+// header block of the stream, and routes the frames it produced. Abort frames
+// abort the dead-letter stream.
+func (r *Router) deadLetter(s *streams, deadLetter *WriteStream, f *Frame) {
+	if f.Flags.Is(ABORT) {
+		deadLetter.Abort(errors.New(string(f.Contents())))
+		r.routePending(s)
+		return
+	}
+	contents := f.Contents()
+	if skip := s.skipped[f.Id]; skip > 0 {
+		if skip > len(contents) {
+			skip = len(contents)
+		}
+		contents = contents[skip:]
+		s.skipped[f.Id] -= skip
+	}
+	deadLetter.Write(contents)
+	if f.Flags.Is(LASTFRAME) {
+		deadLetter.Close()
+	}
+	r.routePending(s)
+}
+
+// replyError tells the sender of the first frame f why its stream was not
+// routed, when the stream has a reply-to header
+func (r *Router) replyError(s *streams, f *Frame, reason error) {
+	if !f.Flags.Is(HEADERS) {
+		return
+	}
+	headers, _ := f.Headers()
+	replyTo, ok := headers[HEADER_REPLY_TO]
+	if !ok || replyTo == f.Dest {
+		return
+	}
+	destination, err := ParseDestination(replyTo)
+	if err != nil {
+		log.WithField("Frame", f.String()).WithField("ReplyTo", replyTo).WithError(err).Warn("Invalid reply-to header")
+		return
+	}
+	reply := NewWriteStream(newDaemonMsgId(), destination, s.pending)
+	reply.SetHeader(HEADER_CORRELATION_ID, f.Id.String())
+	reply.SetHeader(HEADER_ERROR, reason.Error())
+	reply.Close()
+	r.routePending(s)
+}
+
+// routePending routes the frames written by the router to s.pending
+func (r *Router) routePending(s *streams) {
+	for {
+		select {
+		case pending := <-s.pending:
+			r.route(s, pending)
+		default:
+			return
+		}
+	}
+}
+
+// StreamCount is the number of streams open on a target of a rule
+type StreamCount struct {
+	Rule    string  `json:"rule"`
+	Address Address `json:"address"`
+	Streams int     `json:"streams"`
+}
+
+type streamOwner struct {
+	rule    string
+	address Address
+}
+
+// openStreams counts the streams in flight, it is written by Router.run and
+// read by OpenStreams
+type openStreams struct {
+	counts map[streamOwner]int
+	lock   sync.Mutex
+}
+
+func (o *openStreams) add(rule string, addresses Addresses) []streamOwner {
+	owners := make([]streamOwner, len(addresses))
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for i, address := range addresses {
+		owners[i] = streamOwner{rule, address}
+		o.counts[owners[i]]++
+	}
+	return owners
+}
+
+func (o *openStreams) remove(owners []streamOwner) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, owner := range owners {
+		o.counts[owner]--
+		if o.counts[owner] <= 0 {
+			delete(o.counts, owner)
+		}
+	}
+}
+
+// OpenStreams returns the number of streams in flight per target of the rules
+// starting with prefix
+func (r *Router) OpenStreams(prefix string) []StreamCount {
+	r.open.lock.Lock()
+	res := make([]StreamCount, 0, len(r.open.counts))
+	for owner, count := range r.open.counts {
+		if strings.HasPrefix(owner.rule, prefix) {
+			res = append(res, StreamCount{Rule: owner.rule, Address: owner.address, Streams: count})
+		}
+	}
+	r.open.lock.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Rule != res[j].Rule {
+			return res[i].Rule < res[j].Rule
+		}
+		if res[i].Address.Node != res[j].Address.Node {
+			return res[i].Address.Node < res[j].Address.Node
+		}
+		return res[i].Address.Process < res[j].Address.Process
+	})
+	return res
+}
+
+// Metrics returns the counters of undelivered streams and circuits
+func (r *Router) Metrics() RouterMetrics {
+	return RouterMetrics{
+		DeadLettered:   atomic.LoadUint64(&r.metrics.DeadLettered),
+		DroppedStreams: atomic.LoadUint64(&r.metrics.DroppedStreams),
+		DroppedFrames:  atomic.LoadUint64(&r.metrics.DroppedFrames),
+		SendFailures:   atomic.LoadUint64(&r.metrics.SendFailures),
+		CircuitsOpened: atomic.LoadUint64(&r.metrics.CircuitsOpened),
+		CircuitsClosed: atomic.LoadUint64(&r.metrics.CircuitsClosed),
+		OpenCircuits:   r.breakers.openCircuits(),
+		AbortedStreams: atomic.LoadUint64(&r.metrics.AbortedStreams),
+		AbortedTargets: atomic.LoadUint64(&r.metrics.AbortedTargets),
+	}
+}
+
 func (r *Router) Recv() chan<- *Frame {
 	return r.recv
 }
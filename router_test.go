@@ -16,7 +16,11 @@ limitations under the License.
 package hyenad
 
 import (
+	"encoding/json"
+	"errors"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -26,7 +30,7 @@ func TestRouter(t *testing.T) {
 	factory := newLogConnectionFactory()
 	router := NewRouter(&routing, factory)
 	frames := make(chan *Frame)
-	stream := NewWriteStream(CreateMid(0, 0, 1), "/test", frames)
+	stream := NewWriteStream(CreateMid(0, 0, 1), MustParseDestination("s:/test"), frames)
 	toSend := []byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 200))
 	go func() {
 		stream.Write(toSend)
@@ -39,3 +43,236 @@ func TestRouter(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	router.Stop()
 }
+
+// sendStream sends data in frames of MinFrameSize, so that most test streams
+// span several frames
+func sendStream(router Router, id MsgId, dest string, data []byte) {
+	sendSizedStream(router, id, dest, data, MinFrameSize)
+}
+
+func sendSizedStream(router Router, id MsgId, dest string, data []byte, frameSize int) {
+	frames := make(chan *Frame)
+	stream := NewWriteStream(id, MustParseDestination(dest), frames)
+	stream.SetFrameSize(frameSize)
+	go func() {
+		stream.Write(data)
+		stream.Close()
+		close(frames)
+	}()
+	for f := range frames {
+		router.Recv() <- f
+	}
+}
+
+func TestRouterFailover(t *testing.T) {
+	closed := &countingConnection{ok: false}
+	live := &countingConnection{ok: true}
+	factory := countingConnectionFactory{
+		Address{0, 2}: closed,
+		Address{0, 3}: live,
+	}
+	// 0.1 has no connection at all, 0.2 is closed
+	routing := staticRouting{Addresses: Addresses{Address{0, 1}, Address{0, 2}, Address{0, 3}}}
+	router := NewRouter(routing, factory)
+	sendStream(router, CreateMid(0, 0, 1), "s:/test", []byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)))
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if closed.count() != 0 {
+		t.Errorf("Closed connection received %v frames", closed.count())
+	}
+	if live.count() != 3 {
+		t.Errorf("Expected 3 frames on live connection, got %v", live.count())
+	}
+}
+
+func TestRouterBroadcast(t *testing.T) {
+	InitFrameBuffers()
+	first := &countingConnection{ok: true}
+	second := &countingConnection{ok: true}
+	closed := &countingConnection{ok: false}
+	factory := countingConnectionFactory{
+		Address{0, 1}: first,
+		Address{0, 2}: second,
+		Address{0, 3}: closed,
+	}
+	routing := staticRouting{Addresses: Addresses{Address{0, 1}, Address{0, 2}, Address{0, 3}}, Broadcast: true}
+	router := NewRouter(routing, factory)
+	sendStream(router, CreateMid(0, 0, 1), "s:/cache/invalidate", []byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)))
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if first.count() != 3 || second.count() != 3 {
+		t.Errorf("Expected 3 frames on every live target, got %v and %v", first.count(), second.count())
+	}
+	if closed.count() != 0 {
+		t.Errorf("Closed connection received %v frames", closed.count())
+	}
+}
+
+func TestRouterLocalNode(t *testing.T) {
+	remote := &countingConnection{ok: true}
+	closed := &countingConnection{ok: false}
+	local := &countingConnection{ok: true, queue: 5}
+	factory := countingConnectionFactory{
+		Address{1, 1}: remote,
+		Address{2, 1}: closed,
+		Address{2, 2}: local,
+	}
+	targets := Addresses{Address{1, 1}, Address{2, 1}, Address{2, 2}}
+	for _, policy := range []Policy{FAILOVER, LEAST_QUEUED, ROUND_ROBIN} {
+		router := NewRouter(staticRouting{Addresses: targets, Policy: policy}, factory, LocalNode(2))
+		route := router.routing.Route(MustParseDestination("s:/test"))
+		conn, _, err := router.selectConnection(route, "s:/test")
+		if err != nil || conn != local {
+			t.Errorf("%v: expected the live local target, got %v, %v", policy, conn, err)
+		}
+		router.Stop()
+	}
+	local.ok = false
+	router := NewRouter(staticRouting{Addresses: targets}, factory, LocalNode(2))
+	conn, _, err := router.selectConnection(router.routing.Route(MustParseDestination("s:/test")), "s:/test")
+	if err != nil || conn != remote {
+		t.Errorf("Expected fallback to the remote target, got %v, %v", conn, err)
+	}
+	router.Stop()
+}
+
+func TestLocalConnectionFactoryNode(t *testing.T) {
+	InitFrameBuffers()
+	routing := NewRoutingTree()
+	factory := &LocalConnectionFactory{connections: make(map[uint32]Connection), maxFrameSize: MaxFrameSize, node: 2}
+	router := NewRouter(routing, factory, LocalNode(2))
+	defer router.Stop()
+	control := NewRoutingControl(routing, nil, router.Recv())
+	control.SetRouter(router)
+	control.AllowJoin([]string{"s:/dyn"})
+	factory.Register(DAEMON_PID, control)
+	client := pipeClient(t, factory, 1, silentListener{})
+	if client.address != (Address{2, 1}) {
+		t.Errorf("Expected the client on node 2, got %v", client.address)
+	}
+	routing.UpsertSimpleRule("s:/dyn", Simple{Targets: Addresses{Address{1, 1}}})
+	if err := client.Register("s:/dyn"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := factory.Get(Address{0, 1}, nil); err == nil {
+		t.Errorf("Expected process 1 of node 0 to be unreachable")
+	}
+	// The registered target is local and preferred to the remote one
+	route := routing.Route(MustParseDestination("s:/dyn/1"))
+	if !reflect.DeepEqual(route.Addresses, Addresses{Address{1, 1}, Address{2, 1}}) {
+		t.Errorf("Expected the client registered on node 2, got %v", route.Addresses)
+	}
+	_, address, err := router.selectConnection(route, "s:/dyn/1")
+	if err != nil || address != (Address{2, 1}) {
+		t.Errorf("Expected the registered local target, got %v, %v (%+v)", address, err, route)
+	}
+}
+
+func TestRouterDeadLetter(t *testing.T) {
+	dead := &collectingConnection{}
+	routing := NewRoutingTree()
+	deadLetter := "s:/dead"
+	routing.Apply(RoutingTreeUpdate{
+		Services:   map[string]Simple{"s:/dead": Simple{Targets: Addresses{Address{0, 9}}}},
+		DeadLetter: &deadLetter,
+	})
+	router := NewRouter(routing, mapConnectionFactory{Address{0, 9}: dead})
+	data := strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20)
+	sendStream(router, CreateMid(0, 0, 1), "s:/nowhere", []byte(data))
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	lines := strings.SplitN(dead.String(), "\n", 2)
+	if len(lines) != 2 {
+		t.Fatalf("Expected a dead letter header line, got %q", dead.String())
+	}
+	header := DeadLetter{}
+	err := json.Unmarshal([]byte(lines[0]), &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Destination != "s:/nowhere" || header.Id != CreateMid(0, 0, 1).String() || header.Reason == "" {
+		t.Errorf("Unexpected dead letter header %+v", header)
+	}
+	if lines[1] != data {
+		t.Errorf("Expected original contents in dead letter, got %q", lines[1])
+	}
+	if m := router.Metrics(); m.DeadLettered != 1 || m.DroppedStreams != 0 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+}
+
+func TestRouterDropUnroutable(t *testing.T) {
+	data := []byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20))
+	router := NewRouter(staticRouting{}, countingConnectionFactory{})
+	sendStream(router, CreateMid(0, 0, 1), "s:/nowhere", data)
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if m := router.Metrics(); m.DroppedStreams != 1 || m.DroppedFrames != 2 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+	// The dead-letter destination has no live target either, the dead letter
+	// is dropped instead of looping
+	router = NewRouter(staticRouting{DeadLetter: "s:/dead"}, countingConnectionFactory{})
+	sendStream(router, CreateMid(0, 0, 2), "s:/nowhere", data)
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if m := router.Metrics(); m.DeadLettered != 1 || m.DroppedStreams != 1 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+}
+
+func TestRouterAbortFailedTarget(t *testing.T) {
+	InitFrameBuffers()
+	failing := &collectingConnection{failures: map[uint64]error{1: errors.New("Send queue full")}}
+	live := &collectingConnection{}
+	routing := staticRouting{Addresses: Addresses{Address{0, 1}, Address{0, 2}}, Broadcast: true}
+	router := NewRouter(routing, mapConnectionFactory{Address{0, 1}: failing, Address{0, 2}: live})
+	data := []byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 20))
+	sendStream(router, CreateMid(0, 0, 1), "s:/test", data)
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	if live.String() != string(data) {
+		t.Errorf("Expected the whole stream on the live target, got %q", live.String())
+	}
+	checkAborted := func(c *collectingConnection) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if !reflect.DeepEqual(c.numbers, []uint64{0, 1}) || !c.flags[1].Is(LASTFRAME) || !c.flags[1].Is(ABORT) {
+			t.Errorf("Expected the stream aborted after its first frame, got frames %v flags %v", c.numbers, c.flags)
+		}
+	}
+	checkAborted(failing)
+	if m := router.Metrics(); m.AbortedTargets != 1 || m.DroppedFrames != 0 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+	// A stream left without target is dropped
+	failing = &collectingConnection{failures: map[uint64]error{1: errors.New("Send queue full")}}
+	router = NewRouter(staticRouting{Addresses: Addresses{Address{0, 1}}}, mapConnectionFactory{Address{0, 1}: failing})
+	sendStream(router, CreateMid(0, 0, 2), "s:/test", data)
+	time.Sleep(100 * time.Millisecond)
+	router.Stop()
+	checkAborted(failing)
+	if m := router.Metrics(); m.AbortedTargets != 1 || m.DroppedFrames != 1 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+	if open := router.OpenStreams(""); len(open) != 0 {
+		t.Errorf("Expected no open stream left, got %v", open)
+	}
+}
+
+func TestFrameRelease(t *testing.T) {
+	InitFrameBuffers()
+	f, err := NewFrame(FrameHeader{Flags: FIRSTFRAME, Dest: "s:/test"}, []byte("Lorel Ipsum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.retain(1)
+	f.Release()
+	if atomic.LoadInt32(&f.refs) != 0 {
+		t.Errorf("Expected frame to have a remaining owner, refs=%v", f.refs)
+	}
+	f.Release()
+	if atomic.LoadInt32(&f.refs) != -1 {
+		t.Errorf("Expected frame to be released, refs=%v", f.refs)
+	}
+}
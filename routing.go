@@ -19,16 +19,94 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type Routing interface {
-	Route(destination string) Addresses
+	Route(destination Destination) Route
+}
+
+// Route is the result of resolving a destination: the candidate targets and
+// the policy used to pick one of them for a new stream.
+type Route struct {
+	// Rule identifies the rule that produced the route, balancing state is
+	// kept per rule
+	Rule      string    `json:"rule,omitempty"`
+	Addresses Addresses `json:"addresses"`
+	Policy    Policy    `json:"policy,omitempty"`
+	// Broadcast streams are sent to every live target
+	Broadcast bool `json:"broadcast,omitempty"`
+	// DeadLetter is the destination streams are sent to when no target is live
+	DeadLetter string `json:"deadLetter,omitempty"`
+	// Destination is the destination after rewrites, it is empty when no
+	// rewrite rule applied
+	Destination string `json:"destination,omitempty"`
+	// Error tells why the destination could not be resolved
+	Error string `json:"error,omitempty"`
 }
 
 type Addresses []Address
 
+func (a Addresses) contains(address Address) bool {
+	for _, candidate := range a {
+		if candidate == address {
+			return true
+		}
+	}
+	return false
+}
+
 var INVALID_ADDRESS = Address{0, 0}
 
+// DAEMON_PID is the process id of hyenad itself, used by the streams it sends
+// and receives
+const DAEMON_PID uint32 = 0xFFFFFFFF
+
+var DAEMON_ADDRESS = Address{0, DAEMON_PID}
+
+var daemonMsgIds uint64
+
+// newDaemonMsgId returns a new id for a stream sent by hyenad itself
+func newDaemonMsgId() MsgId {
+	return CreateMid(DAEMON_ADDRESS.Node, DAEMON_ADDRESS.Process, atomic.AddUint64(&daemonMsgIds, 1))
+}
+
+// REPLY_SEGMENT is the first segment of the path of reply destinations
+const REPLY_SEGMENT = "reply"
+
+// ReplyDestination is the destination of replies to the stream id, it is
+// routed back to the sender of the stream
+func ReplyDestination(id MsgId) Destination {
+	return replyDestination(id, "")
+}
+
+// replyDestination is the ReplyDestination of id followed by token, a secret
+// segment that tells the replies to a request from forged ones
+func replyDestination(id MsgId, token string) Destination {
+	nid, pid, _ := id.Split()
+	dest := fmt.Sprintf("x:%v/%v/%v/%v", nid, pid, REPLY_SEGMENT, id)
+	if token != "" {
+		dest += "/" + token
+	}
+	return MustParseDestination(dest)
+}
+
+// repliedId returns the id of the stream replied to by a stream sent to
+// destination and the token of the destination, if destination is a
+// ReplyDestination
+func repliedId(destination string) (MsgId, string, bool) {
+	parsed, err := ParseDestination(destination)
+	if err != nil || !parsed.Explicit() || len(parsed.Segments) < 2 || len(parsed.Segments) > 3 || parsed.Segments[0] != REPLY_SEGMENT {
+		return MsgId{}, "", false
+	}
+	id, err := ParseMsgId(parsed.Segments[1])
+	token := ""
+	if len(parsed.Segments) == 3 {
+		token = parsed.Segments[2]
+	}
+	return id, token, err == nil
+}
+
 type Address struct {
 	Node    uint32
 	Process uint32
@@ -44,11 +122,11 @@ func (a *Address) UnmarshalJSON(input []byte) error {
 		return fmt.Errorf("Invalid Address Format")
 	}
 	ns, ps := pair[0], pair[1]
-	n, err := strconv.ParseInt(ns, 10, 32)
+	n, err := strconv.ParseUint(ns, 10, 32)
 	if err != nil {
 		return err
 	}
-	p, err := strconv.ParseInt(ps, 10, 32)
+	p, err := strconv.ParseUint(ps, 10, 32)
 	if err != nil {
 		return err
 	}
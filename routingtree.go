@@ -16,113 +16,604 @@ limitations under the License.
 package hyenad
 
 import (
+	log "github.com/Sirupsen/logrus"
 	"gopkg.in/tchap/go-patricia.v2/patricia"
-	"strconv"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+// RoutingTree maps destinations to targets. The rule with the empty prefix is
+// the default route, it matches destinations no other rule matches. Its rules
+// are held in an immutable routingTable: lookups never block, and updates build
+// a modified copy of the table under a lock and swap it in, so every update
+// becomes visible at once.
 type RoutingTree struct {
-	trie *patricia.Trie
-	lock sync.Mutex
+	table atomic.Value
+	lock  sync.Mutex
+	// leases of the targets added for a limited time, guarded by lock
+	leases map[leaseKey]*Lease
+	// registered are the targets added by AddTarget, leased or not, numbered
+	// in registration order. Replace keeps them. Guarded by lock.
+	registered    map[leaseKey]uint64
+	registrations uint64
+	// declared are the prefixes of the rules set by Apply and Replace, as
+	// opposed to the rules created by registrations. Guarded by lock.
+	declared map[string]bool
+}
+
+// routingTable is never modified once stored in a RoutingTree. The trie is
+// only used for lookups, walking it sorts its nodes in place and would race
+// with them: rules holds the same items for iteration.
+type routingTable struct {
+	trie       *patricia.Trie
+	rules      map[string]patricia.Item
+	patterns   map[string]*pattern
+	reserved   map[string]bool
+	deadLetter string
+	// rewrites maps source prefixes to their new prefix, rewriteTrie holds
+	// the same rules for lookups
+	rewrites    map[string]string
+	rewriteTrie *patricia.Trie
 }
 
 type RoutingTreeUpdate struct {
-	Deletes  []string           `json:"delete,omitempty"`
-	Services map[string]Simple  `json:"services,omitempty"`
-	Shards   map[string]Sharded `json:"shards,omitempty"`
+	Deletes    []string               `json:"delete,omitempty"`
+	Services   map[string]Simple      `json:"services,omitempty"`
+	Shards     map[string]Sharded     `json:"shards,omitempty"`
+	HashShards map[string]HashSharded `json:"hashShards,omitempty"`
+	// Rewrites maps source prefixes to the prefix they are routed as
+	Rewrites map[string]string `json:"rewrites,omitempty"`
+	// DeadLetter is the destination of unroutable streams, nil leaves it
+	// unchanged and an empty destination disables dead letters
+	DeadLetter *string `json:"deadLetter,omitempty"`
+	// unknown are the unknown sections met when decoding the update
+	unknown []string
 }
 
 func NewRoutingTree() *RoutingTree {
-	return &RoutingTree{
-		trie: patricia.NewTrie(),
+	res := &RoutingTree{leases: make(map[leaseKey]*Lease), registered: make(map[leaseKey]uint64), declared: make(map[string]bool)}
+	res.table.Store(newRoutingTable())
+	return res
+}
+
+func newRoutingTable() *routingTable {
+	return &routingTable{
+		trie:        patricia.NewTrie(),
+		rules:       make(map[string]patricia.Item),
+		patterns:    make(map[string]*pattern),
+		reserved:    make(map[string]bool),
+		rewrites:    make(map[string]string),
+		rewriteTrie: patricia.NewTrie(),
+	}
+}
+
+func (r *RoutingTree) load() *routingTable {
+	return r.table.Load().(*routingTable)
+}
+
+// update applies change to a copy of the current table and publishes it
+func (r *RoutingTree) update(change func(t *routingTable)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	t := r.load().clone()
+	change(t)
+	r.table.Store(t)
+}
+
+func (t *routingTable) clone() *routingTable {
+	res := routingTable{
+		trie:        patricia.NewTrie(),
+		rules:       make(map[string]patricia.Item, len(t.rules)),
+		patterns:    make(map[string]*pattern, len(t.patterns)),
+		reserved:    make(map[string]bool, len(t.reserved)),
+		deadLetter:  t.deadLetter,
+		rewrites:    make(map[string]string, len(t.rewrites)),
+		rewriteTrie: patricia.NewTrie(),
+	}
+	for key, item := range t.rules {
+		res.put(key, item)
+	}
+	for source, target := range t.rewrites {
+		res.setRewrite(source, target)
 	}
+	for key, p := range t.patterns {
+		res.patterns[key] = p
+	}
+	for key := range t.reserved {
+		res.reserved[key] = true
+	}
+	return &res
 }
 
 func (r *RoutingTree) Apply(update RoutingTreeUpdate) {
+	r.update(func(t *routingTable) {
+		t.apply(update)
+		r.declare(update)
+	})
+}
+
+// declare records the rules set and deleted by update, it must be called
+// with lock held
+func (r *RoutingTree) declare(update RoutingTreeUpdate) {
+	for _, prefix := range update.Deletes {
+		delete(r.declared, prefix)
+	}
+	for prefix := range update.Services {
+		r.declared[prefix] = true
+	}
+	for prefix := range update.Shards {
+		r.declared[prefix] = true
+	}
+	for prefix := range update.HashShards {
+		r.declared[prefix] = true
+	}
+}
+
+// Declared returns true if the rule at prefix was set by Apply or Replace
+func (r *RoutingTree) Declared(prefix string) bool {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	for _, delete := range update.Deletes {
-		r.trie.Delete(patricia.Prefix(delete))
+	return r.declared[prefix]
+}
+
+// apply skips reserved prefixes, they can only be changed through Reserve
+func (t *routingTable) apply(update RoutingTreeUpdate) {
+	for _, prefix := range update.Deletes {
+		if !t.reserved[prefix] {
+			t.trie.Delete(patricia.Prefix(prefix))
+			delete(t.rules, prefix)
+			delete(t.patterns, prefix)
+		}
+		t.deleteRewrite(prefix)
 	}
 	for prefix, service := range update.Services {
-		r.trie.Insert(patricia.Prefix(prefix), service)
+		t.set(prefix, service)
+	}
+	for prefix, shard := range update.Shards {
+		t.set(prefix, shard)
+	}
+	for prefix, shard := range update.HashShards {
+		t.set(prefix, newHashShardRule(shard))
 	}
-	for prefix, shard := range update.Services {
-		r.trie.Insert(patricia.Prefix(prefix), shard)
+	for source, target := range update.Rewrites {
+		t.setRewrite(source, target)
+	}
+	if update.DeadLetter != nil {
+		t.deadLetter = *update.DeadLetter
 	}
 }
 
-func (r *RoutingTree) UpsertSimpleRule(prefix string, rule Simple) {
+func (t *routingTable) set(key string, rule patricia.Item) {
+	if t.capturesReserved(key) {
+		return
+	}
+	t.put(key, rule)
+	if isPattern(key) {
+		t.patterns[key] = compilePattern(key)
+	}
+}
+
+func (t *routingTable) put(key string, rule patricia.Item) {
+	t.trie.Set(patricia.Prefix(key), rule)
+	t.rules[key] = rule
+}
+
+// Reserve installs a rule owned by hyenad itself, the rules and rewrites of
+// updates that could capture its destinations are skipped. Reserved rules are
+// ignored by Diff and Replace.
+func (r *RoutingTree) Reserve(prefix string, rule Simple) {
+	r.update(func(t *routingTable) {
+		t.reserved[prefix] = true
+		t.put(prefix, rule)
+	})
+}
+
+// capturesReserved returns true if a rule at key could route destinations of
+// a reserved prefix: plain prefixes inside a reserved subtree, and patterns
+// whose literal segments before their first wildcard overlap one
+func (t *routingTable) capturesReserved(key string) bool {
+	if isPattern(key) {
+		return t.reservedOverlap(literalPrefix(key))
+	}
+	for prefix := range t.reserved {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserved returns the keys of update that touch a reserved subtree
+func (r *RoutingTree) Reserved(update RoutingTreeUpdate) []string {
+	t := r.load()
+	var res []string
+	for _, prefix := range update.Deletes {
+		if t.reserved[prefix] {
+			res = append(res, prefix)
+		}
+	}
+	for prefix := range update.Services {
+		if t.capturesReserved(prefix) {
+			res = append(res, prefix)
+		}
+	}
+	for prefix := range update.Shards {
+		if t.capturesReserved(prefix) {
+			res = append(res, prefix)
+		}
+	}
+	for prefix := range update.HashShards {
+		if t.capturesReserved(prefix) {
+			res = append(res, prefix)
+		}
+	}
+	for source := range update.Rewrites {
+		if t.reservedOverlap(source) {
+			res = append(res, source)
+		}
+	}
+	return res
+}
+
+// Diff returns the update that would turn the current rules into the rules
+// declared by config, config.Deletes is ignored. Registered targets are kept.
+func (r *RoutingTree) Diff(config RoutingTreeUpdate) RoutingTreeUpdate {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.trie.Insert(patricia.Prefix(prefix), rule)
+	declared, _ := r.withRegistrations(config)
+	return r.load().diff(declared)
+}
+
+// withRegistrations returns the rules of config with the registered targets
+// added in registration order, and the registrations its rules no longer
+// accept. It must be called with lock held.
+func (r *RoutingTree) withRegistrations(config RoutingTreeUpdate) (RoutingTreeUpdate, []leaseKey) {
+	if len(r.registered) == 0 {
+		return config, nil
+	}
+	keys := make([]leaseKey, 0, len(r.registered))
+	for key := range r.registered {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return r.registered[keys[i]] < r.registered[keys[j]]
+	})
+	t := newRoutingTable()
+	t.apply(config)
+	var rejected []leaseKey
+	for _, key := range keys {
+		if err := t.addTarget(key.registration, key.address); err != nil {
+			rejected = append(rejected, key)
+		}
+	}
+	return t.snapshot(), rejected
+}
+
+// diff deletes the rules and rewrites config no longer declares, a delete
+// removes both the rule and the rewrite at its prefix so what config still
+// declares there is set again
+func (t *routingTable) diff(config RoutingTreeUpdate) RoutingTreeUpdate {
+	res := RoutingTreeUpdate{Services: make(map[string]Simple), Shards: make(map[string]Sharded), HashShards: make(map[string]HashSharded), Rewrites: make(map[string]string)}
+	deleted := make(map[string]bool)
+	for _, prefix := range sortedKeys(t.rules) {
+		if t.reserved[prefix] {
+			continue
+		}
+		_, isService := config.Services[prefix]
+		_, isShard := config.Shards[prefix]
+		_, isHashShard := config.HashShards[prefix]
+		if !isService && !isShard && !isHashShard {
+			deleted[prefix] = true
+		}
+	}
+	for _, source := range sortedKeys(t.rewrites) {
+		if _, isRewrite := config.Rewrites[source]; !isRewrite {
+			deleted[source] = true
+		}
+	}
+	res.Deletes = sortedKeys(deleted)
+	for source, target := range config.Rewrites {
+		if current, ok := t.rewrites[source]; deleted[source] || !ok || current != target {
+			res.Rewrites[source] = target
+		}
+	}
+	for prefix, service := range config.Services {
+		if deleted[prefix] || !reflect.DeepEqual(t.trie.Get(patricia.Prefix(prefix)), service) {
+			res.Services[prefix] = service
+		}
+	}
+	for prefix, shard := range config.Shards {
+		if deleted[prefix] || !reflect.DeepEqual(t.trie.Get(patricia.Prefix(prefix)), shard) {
+			res.Shards[prefix] = shard
+		}
+	}
+	for prefix, shard := range config.HashShards {
+		rule, ok := t.trie.Get(patricia.Prefix(prefix)).(*hashShardRule)
+		if deleted[prefix] || !ok || !reflect.DeepEqual(rule.HashSharded, shard) {
+			res.HashShards[prefix] = shard
+		}
+	}
+	deadLetter := ""
+	if config.DeadLetter != nil {
+		deadLetter = *config.DeadLetter
+	}
+	if deadLetter != t.deadLetter {
+		res.DeadLetter = &deadLetter
+	}
+	return res
+}
+
+// Snapshot returns the rules of the tree, reserved rules included, as an
+// update that would recreate them.
+func (r *RoutingTree) Snapshot() RoutingTreeUpdate {
+	return r.load().snapshot()
+}
+
+func (table *routingTable) snapshot() RoutingTreeUpdate {
+	res := RoutingTreeUpdate{}
+	for source, target := range table.rewrites {
+		if res.Rewrites == nil {
+			res.Rewrites = make(map[string]string)
+		}
+		res.Rewrites[source] = target
+	}
+	if table.deadLetter != "" {
+		deadLetter := table.deadLetter
+		res.DeadLetter = &deadLetter
+	}
+	for prefix, item := range table.rules {
+		switch t := item.(type) {
+		case Simple:
+			{
+				if res.Services == nil {
+					res.Services = make(map[string]Simple)
+				}
+				res.Services[prefix] = t
+			}
+		case Sharded:
+			{
+				if res.Shards == nil {
+					res.Shards = make(map[string]Sharded)
+				}
+				res.Shards[prefix] = t
+			}
+		case *hashShardRule:
+			{
+				if res.HashShards == nil {
+					res.HashShards = make(map[string]HashSharded)
+				}
+				res.HashShards[prefix] = t.HashSharded
+			}
+		}
+	}
+	return res
+}
+
+// Replace makes the rules of the tree match the rules declared by config,
+// touching only the rules that changed, and returns the applied difference.
+// Registered targets are kept, unless the rules of config no longer accept
+// them.
+func (r *RoutingTree) Replace(config RoutingTreeUpdate) RoutingTreeUpdate {
+	var update RoutingTreeUpdate
+	r.update(func(t *routingTable) {
+		declared, rejected := r.withRegistrations(config)
+		for _, key := range rejected {
+			log.WithField("Registration", key.registration).WithField("Address", key.address).Warn("Dropping registration rejected by the new routing")
+			delete(r.registered, key)
+			delete(r.leases, key)
+		}
+		update = t.diff(declared)
+		t.apply(update)
+		r.declared = make(map[string]bool)
+		r.declare(config)
+	})
+	return update
+}
+
+func (r *RoutingTree) UpsertSimpleRule(prefix string, rule Simple) {
+	r.Apply(RoutingTreeUpdate{Services: map[string]Simple{prefix: rule}})
 }
 
 func (r *RoutingTree) RemoveRule(prefix string) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	r.trie.Delete(patricia.Prefix(prefix))
+	r.Apply(RoutingTreeUpdate{Deletes: []string{prefix}})
 }
 
 func (r *RoutingTree) UpsertShardedRule(prefix string, rule Sharded) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	r.trie.Insert(patricia.Prefix(prefix), rule)
-}
-
-func (r *RoutingTree) Route(destination string) Addresses {
-	if strings.HasPrefix(destination, "x:") {
-		parts := strings.Split(destination, "/")
-		if len(parts) < 2 {
-			return Addresses([]Address{})
-		} else {
-			nid, err := strconv.ParseInt(parts[0], 10, 32)
-			pid, err := strconv.ParseInt(parts[1], 10, 32)
-			if err != nil {
-				return Addresses([]Address{})
-			}
-			return Addresses([]Address{Address{uint32(nid), uint32(pid)}})
+	r.Apply(RoutingTreeUpdate{Shards: map[string]Sharded{prefix: rule}})
+}
+
+func (r *RoutingTree) UpsertHashShardedRule(prefix string, rule HashSharded) {
+	r.Apply(RoutingTreeUpdate{HashShards: map[string]HashSharded{prefix: rule}})
+}
+
+func (r *RoutingTree) Route(destination Destination) Route {
+	return r.load().resolve(destination, nil)
+}
+
+// Explanation details how a RoutingTree resolves a destination
+type Explanation struct {
+	Destination string `json:"destination"`
+	// Rewrites lists the destination after each rewrite rule applied
+	Rewrites []string `json:"rewrites,omitempty"`
+	// Type is the type of the matched rule: explicit, simple, sharded or
+	// hashSharded, it is empty when no rule matched
+	Type string `json:"type,omitempty"`
+	// Prefix is the key of the matched rule
+	Prefix   string      `json:"prefix,omitempty"`
+	ShardKey string      `json:"shardKey,omitempty"`
+	Shard    *ShardEntry `json:"shard,omitempty"`
+	// SplitKey is the captured value picking the group of a Simple rule
+	// with groups, Group is the picked group
+	SplitKey string `json:"splitKey,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Route    Route  `json:"route"`
+}
+
+// Explain resolves destination like Route does, and details how the route
+// was found.
+func (r *RoutingTree) Explain(destination string) Explanation {
+	e := Explanation{Destination: destination}
+	parsed, err := ParseDestination(destination)
+	if err != nil {
+		e.Route = Route{Error: err.Error()}
+		return e
+	}
+	e.Route = r.load().resolve(parsed, &e)
+	return e
+}
+
+// resolve is the implementation of Route, it fills explanation when not nil
+func (t *routingTable) resolve(destination Destination, explanation *Explanation) Route {
+	original := destination.String()
+	rewritten, err := t.rewrite(original, explanation)
+	if err == nil && rewritten != original {
+		destination, err = ParseDestination(rewritten)
+	}
+	if err != nil {
+		return Route{Error: err.Error(), DeadLetter: t.deadLetter}
+	}
+	route := t.lookup(destination, explanation)
+	if rewritten != original {
+		route.Destination = rewritten
+	}
+	route.DeadLetter = t.deadLetter
+	return route
+}
+
+func (t *routingTable) lookup(destination Destination, explanation *Explanation) Route {
+	if destination.Explicit() {
+		if explanation != nil {
+			explanation.Type = "explicit"
 		}
+		return Route{Addresses: Addresses{destination.Address}}
 	} else {
-		r.lock.Lock()
-		defer r.lock.Unlock()
-		var longestKey patricia.Prefix
-		var ruleItem patricia.Item
-		r.trie.VisitPrefixes(patricia.Prefix(destination), func(key patricia.Prefix, value patricia.Item) error {
-			if len(key) > len(longestKey) {
-				longestKey = key
-				ruleItem = value
-			}
-			return nil
-		})
-		switch t := ruleItem.(type) {
+		match, ok := t.match(destination.String())
+		if !ok {
+			return Route{}
+		}
+		if explanation != nil {
+			explanation.Prefix = match.key
+		}
+		switch rule := match.item.(type) {
 		case Sharded:
 			{
-				shardParts := strings.Split(destination[len(longestKey):], "/")
-				if len(shardParts) < 1 {
-					return Addresses([]Address{})
+				shard := match.shardKey()
+				if explanation != nil {
+					explanation.Type = "sharded"
+					explanation.ShardKey = shard
 				}
-				shard := shardParts[0]
-				for _, r := range t {
+				for i, r := range rule {
 					if shard >= r.From && shard <= r.To {
-						return r.Addresses()
+						if explanation != nil {
+							explanation.Shard = &rule[i]
+						}
+						return Route{Rule: match.key + "[" + r.From + "]", Addresses: r.Addresses(), Policy: r.Policy, Broadcast: r.Broadcast}
 					}
 				}
 			}
+		case *hashShardRule:
+			{
+				shard := match.shardKey()
+				if explanation != nil {
+					explanation.Type = "hashSharded"
+					explanation.ShardKey = shard
+				}
+				return Route{Rule: match.key, Addresses: rule.ring.lookup(shard)}
+			}
 		case Simple:
 			{
-				return t.Addresses()
+				if explanation != nil {
+					explanation.Type = "simple"
+				}
+				if len(rule.Groups) > 0 {
+					return t.split(match, rule, explanation)
+				}
+				return Route{Rule: match.key, Addresses: rule.Addresses(), Policy: rule.Policy, Broadcast: rule.Broadcast}
 			}
 		}
 	}
-	return Addresses([]Address{})
+	return Route{}
+}
+
+// ruleMatch is the rule taking precedence for a destination
+type ruleMatch struct {
+	key  string
+	item patricia.Item
+	// rest is the part of the destination after the rule key
+	rest     string
+	captures []capture
+}
+
+// capture returns the value of the capture named name
+func (m *ruleMatch) capture(name string) (string, bool) {
+	for _, c := range m.captures {
+		if c.name == name {
+			return c.value, true
+		}
+	}
+	return "", false
+}
+
+func (m *ruleMatch) shardKey() string {
+	if shard, ok := m.capture("shard"); ok {
+		return shard
+	}
+	if len(m.captures) > 0 {
+		return m.captures[0].value
+	}
+	return strings.Split(m.rest, "/")[0]
+}
+
+func (t *routingTable) match(destination string) (ruleMatch, bool) {
+	var longestKey patricia.Prefix
+	var ruleItem patricia.Item
+	t.trie.VisitPrefixes(patricia.Prefix(destination), func(key patricia.Prefix, value patricia.Item) error {
+		if (ruleItem == nil || len(key) > len(longestKey)) && t.patterns[string(key)] == nil {
+			longestKey = key
+			ruleItem = value
+		}
+		return nil
+	})
+	found := ruleItem != nil
+	res := ruleMatch{key: string(longestKey), item: ruleItem, rest: destination[len(longestKey):]}
+	var best *pattern
+	var segments []string
+	for _, p := range t.patterns {
+		if best == nil && found && p.literals <= len(longestKey) {
+			continue
+		}
+		if best != nil && !p.moreSpecific(best) {
+			continue
+		}
+		if segments == nil {
+			segments = strings.Split(destination, "/")
+		}
+		consumed, captures, ok := p.match(segments)
+		if !ok {
+			continue
+		}
+		best = p
+		found = true
+		res = ruleMatch{key: p.key, item: t.trie.Get(patricia.Prefix(p.key)), rest: strings.Join(segments[consumed:], "/"), captures: captures}
+	}
+	return res, found
 }
 
 type Sharded []ShardEntry
 
 type Simple struct {
 	Targets Addresses `json:"targets,omitempty"`
+	Policy  Policy    `json:"policy,omitempty"`
+	// Broadcast sends every stream to all the targets
+	Broadcast bool `json:"broadcast,omitempty"`
+	// Groups split new streams between weighted target groups, instead of
+	// sending them to Targets
+	Groups []TargetGroup `json:"groups,omitempty"`
+	// SplitKey names the capture of the rule key picking the group
+	SplitKey string `json:"splitKey,omitempty"`
 }
 
 func (s *Simple) Addresses() Addresses {
@@ -133,6 +624,9 @@ type ShardEntry struct {
 	From    string    `json:"from,omitempty"`
 	To      string    `json:"to,omitempty"`
 	Targets Addresses `json:"targets,omitempty"`
+	Policy  Policy    `json:"policy,omitempty"`
+	// Broadcast sends every stream to all the targets
+	Broadcast bool `json:"broadcast,omitempty"`
 }
 
 func (s *ShardEntry) Addresses() Addresses {
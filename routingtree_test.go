@@ -16,13 +16,20 @@ limitations under the License.
 package hyenad
 
 import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 )
 
 func check(dest string, expected Addresses, routing *RoutingTree, t *testing.T) {
-	res := routing.Route(dest)
+	var res Addresses
+	if destination, err := ParseDestination(dest); err == nil {
+		res = routing.Route(destination).Addresses
+	}
 	if len(expected) == 0 {
 		if len(res) != 0 {
 			t.Errorf("Invalid result, expected [] and got %v\n", res)
@@ -66,6 +73,8 @@ func TestRoutingTree(t *testing.T) {
 	check("s:/test/0008/tata", Addresses{Address{0, 1}}, routing, t)
 	check("s:/test/0018/tata", Addresses{Address{0, 2}}, routing, t)
 	check("s:/test/0030/tata", Addresses{}, routing, t)
+	check("x:3/4/reply", Addresses{Address{3, 4}}, routing, t)
+	check("x:3", Addresses{}, routing, t)
 }
 
 func TestRouterWithRoutingTree(t *testing.T) {
@@ -91,7 +100,7 @@ func TestRouterWithRoutingTree(t *testing.T) {
 	factory := newLogConnectionFactory()
 	router := NewRouter(routing, factory)
 	frames := make(chan *Frame)
-	stream := NewWriteStream(CreateMid(0, 0, 1), "s:/test1/toto/tata", frames)
+	stream := NewWriteStream(CreateMid(0, 0, 1), MustParseDestination("s:/test1/toto/tata"), frames)
 	toSend := []byte(strings.Repeat("Lorel Ipsum Dolor Sic Amet... ", 200))
 	go func() {
 		stream.Write(toSend)
@@ -102,7 +111,7 @@ func TestRouterWithRoutingTree(t *testing.T) {
 		router.Recv() <- f
 	}
 	frames = make(chan *Frame)
-	stream = NewWriteStream(CreateMid(0, 0, 2), "s:/test2/toto/tata", frames)
+	stream = NewWriteStream(CreateMid(0, 0, 2), MustParseDestination("s:/test2/toto/tata"), frames)
 	go func() {
 		stream.Write(toSend)
 		stream.Close()
@@ -114,3 +123,405 @@ func TestRouterWithRoutingTree(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	router.Stop()
 }
+
+func TestRoutingTreeReplace(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/keep":   Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/change": Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/drop":   Simple{Targets: Addresses{Address{0, 1}}},
+		},
+	})
+	update := routing.Replace(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/keep":   Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/change": Simple{Targets: Addresses{Address{0, 2}}},
+		},
+		Shards: map[string]Sharded{
+			"s:/shard/": Sharded{ShardEntry{From: "0", To: "9", Targets: Addresses{Address{0, 3}}}},
+		},
+	})
+	if len(update.Deletes) != 1 || update.Deletes[0] != "s:/drop" {
+		t.Errorf("Expected s:/drop to be deleted, got %v", update.Deletes)
+	}
+	if _, ok := update.Services["s:/keep"]; ok || len(update.Services) != 1 {
+		t.Errorf("Expected only s:/change to be updated, got %v", update.Services)
+	}
+	check("s:/keep/a", Addresses{Address{0, 1}}, routing, t)
+	check("s:/change/a", Addresses{Address{0, 2}}, routing, t)
+	check("s:/drop/a", Addresses{}, routing, t)
+	check("s:/shard/5", Addresses{Address{0, 3}}, routing, t)
+	update = routing.Diff(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/keep":   Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/change": Simple{Targets: Addresses{Address{0, 2}}},
+		},
+		Shards: map[string]Sharded{
+			"s:/shard/": Sharded{ShardEntry{From: "0", To: "9", Targets: Addresses{Address{0, 3}}}},
+		},
+	})
+	if len(update.Deletes)+len(update.Services)+len(update.Shards) != 0 {
+		t.Errorf("Expected no difference after replace, got %v", update)
+	}
+}
+
+func TestRoutingTreeReplaceRuleWithRewrite(t *testing.T) {
+	routing := NewRoutingTree()
+	b := map[string]Simple{"s:/b": Simple{Targets: Addresses{Address{0, 2}}}}
+	routing.Apply(RoutingTreeUpdate{Services: map[string]Simple{
+		"s:/a": Simple{Targets: Addresses{Address{0, 1}}},
+		"s:/b": b["s:/b"],
+	}})
+	routing.Replace(RoutingTreeUpdate{Services: b, Rewrites: map[string]string{"s:/a": "s:/b"}})
+	snapshot := routing.Snapshot()
+	if _, ok := snapshot.Services["s:/a"]; ok || snapshot.Rewrites["s:/a"] != "s:/b" {
+		t.Errorf("Expected s:/a to become a rewrite, got %+v", snapshot)
+	}
+	check("s:/a/1", Addresses{Address{0, 2}}, routing, t)
+	routing.Replace(RoutingTreeUpdate{Services: map[string]Simple{
+		"s:/a": Simple{Targets: Addresses{Address{0, 1}}},
+		"s:/b": b["s:/b"],
+	}})
+	if snapshot := routing.Snapshot(); len(snapshot.Rewrites) != 0 {
+		t.Errorf("Expected the rewrite of s:/a to be removed, got %+v", snapshot)
+	}
+	check("s:/a/1", Addresses{Address{0, 1}}, routing, t)
+}
+
+func TestRoutingTreeReplaceKeepsRegistrations(t *testing.T) {
+	routing := NewRoutingTree()
+	config := RoutingTreeUpdate{Services: map[string]Simple{"s:/static": Simple{Targets: Addresses{Address{0, 1}}}}}
+	routing.Apply(config)
+	routing.AddTarget(Registration{Prefix: "s:/static"}, Address{0, 8})
+	routing.AddTarget(Registration{Prefix: "s:/dyn"}, Address{0, 9})
+	routing.AddTarget(Registration{Prefix: "s:/leased", TTL: time.Minute}, Address{0, 7})
+	update := routing.Replace(config)
+	if len(update.Deletes)+len(update.Services) != 0 {
+		t.Errorf("Expected no change on reload, got %+v", update)
+	}
+	check("s:/static/a", Addresses{Address{0, 1}, Address{0, 8}}, routing, t)
+	check("s:/dyn/a", Addresses{Address{0, 9}}, routing, t)
+	check("s:/leased/a", Addresses{Address{0, 7}}, routing, t)
+	// Changed static targets are replaced, registered ones kept after them
+	config.Services["s:/static"] = Simple{Targets: Addresses{Address{0, 3}}}
+	routing.Replace(config)
+	check("s:/static/a", Addresses{Address{0, 3}, Address{0, 8}}, routing, t)
+	if leases := routing.Leases(); len(leases) != 1 {
+		t.Errorf("Expected the lease kept, got %v", leases)
+	}
+	// Only registered targets are removed
+	routing.RemoveTarget(Registration{Prefix: "s:/static"}, Address{0, 3})
+	routing.RemoveTarget(Registration{Prefix: "s:/static"}, Address{0, 8})
+	check("s:/static/a", Addresses{Address{0, 3}}, routing, t)
+	// Registrations the new rules do not accept are dropped
+	config.HashShards = map[string]HashSharded{"s:/dyn": HashSharded{Targets: Addresses{Address{0, 4}}}}
+	routing.Replace(config)
+	routing.RemoveTarget(Registration{Prefix: "s:/dyn"}, Address{0, 9})
+	check("s:/dyn/5", Addresses{Address{0, 4}}, routing, t)
+	if update := routing.Diff(config); len(update.Deletes)+len(update.Services)+len(update.HashShards) != 0 {
+		t.Errorf("Expected no difference after replace, got %+v", update)
+	}
+}
+
+func TestRoutingTreeReservedSubtree(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.Reserve(ROUTING_PREFIX, Simple{Targets: Addresses{DAEMON_ADDRESS}})
+	update := RoutingTreeUpdate{Services: map[string]Simple{
+		"h:/routing/update": Simple{Targets: Addresses{Address{0, 42}}},
+		"h:/**":             Simple{Targets: Addresses{Address{0, 42}}},
+		"h:/*/dump":         Simple{Targets: Addresses{Address{0, 42}}},
+		"h:/":               Simple{Targets: Addresses{Address{0, 1}}},
+		"h:/admin/*":        Simple{Targets: Addresses{Address{0, 1}}},
+	}}
+	reserved := routing.Reserved(update)
+	sort.Strings(reserved)
+	if !reflect.DeepEqual(reserved, []string{"h:/**", "h:/*/dump", "h:/routing/update"}) {
+		t.Errorf("Expected the keys capturing the reserved subtree, got %v", reserved)
+	}
+	routing.Apply(update)
+	for _, dest := range []string{"h:/routing", "h:/routing/dump", "h:/routing/update"} {
+		check(dest, Addresses{DAEMON_ADDRESS}, routing, t)
+	}
+	check("h:/other", Addresses{Address{0, 1}}, routing, t)
+	check("h:/admin/x", Addresses{Address{0, 1}}, routing, t)
+}
+
+func TestRoutingTreeSnapshot(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/test1": Simple{Targets: Addresses{Address{0, 1}, Address{0, 2}}, Policy: RANDOM},
+		},
+		Shards: map[string]Sharded{
+			"s:/test/": Sharded{ShardEntry{From: "0000", To: "0010", Targets: Addresses{Address{1, 1}}}},
+		},
+		HashShards: map[string]HashSharded{
+			"s:/users/": HashSharded{Targets: Addresses{Address{0, 3}}, Replicas: 8},
+		},
+	})
+	data, err := json.Marshal(routing.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := RoutingTreeUpdate{}
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		t.Fatalf("Snapshot %s does not round trip: %v", data, err)
+	}
+	restored := NewRoutingTree()
+	restored.Apply(snapshot)
+	update := routing.Diff(snapshot)
+	if len(update.Deletes)+len(update.Services)+len(update.Shards)+len(update.HashShards) != 0 {
+		t.Errorf("Snapshot %s differs from routing: %v", data, update)
+	}
+	if !reflect.DeepEqual(restored.Snapshot(), routing.Snapshot()) {
+		t.Errorf("Expected %v, got %v", routing.Snapshot(), restored.Snapshot())
+	}
+}
+
+func TestRoutingTreeDefaultRoute(t *testing.T) {
+	routing := NewRoutingTree()
+	deadLetter := "s:/dead"
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"":       Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/a":   Simple{Targets: Addresses{Address{0, 2}}},
+			"s:/*/b": Simple{Targets: Addresses{Address{0, 3}}},
+		},
+		DeadLetter: &deadLetter,
+	})
+	check("s:/a/1", Addresses{Address{0, 2}}, routing, t)
+	check("s:/x/b", Addresses{Address{0, 3}}, routing, t)
+	check("s:/x/c", Addresses{Address{0, 1}}, routing, t)
+	check("t:/other", Addresses{Address{0, 1}}, routing, t)
+	check("x:3/4/reply", Addresses{Address{3, 4}}, routing, t)
+	if route := routing.Route(MustParseDestination("s:/x/c")); route.Rule != "" || route.DeadLetter != deadLetter {
+		t.Errorf("Expected default route with dead letter, got %+v", route)
+	}
+	snapshot := routing.Snapshot()
+	if snapshot.DeadLetter == nil || *snapshot.DeadLetter != deadLetter {
+		t.Errorf("Expected dead letter in snapshot, got %v", snapshot.DeadLetter)
+	}
+	update := routing.Diff(RoutingTreeUpdate{Services: snapshot.Services})
+	if update.DeadLetter == nil || *update.DeadLetter != "" || len(update.Services)+len(update.Deletes) != 0 {
+		t.Errorf("Expected dead letter removal only, got %+v", update)
+	}
+	routing.Apply(update)
+	routing.RemoveRule("")
+	check("s:/x/c", Addresses{}, routing, t)
+	if route := routing.Route(MustParseDestination("s:/x/c")); route.DeadLetter != "" {
+		t.Errorf("Expected no dead letter, got %q", route.DeadLetter)
+	}
+}
+
+func TestRoutingTreePatterns(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/users":          Simple{Targets: Addresses{Address{0, 1}}},
+			"s:/users/*/avatar": Simple{Targets: Addresses{Address{0, 2}}},
+			"s:/**/health":      Simple{Targets: Addresses{Address{0, 3}}},
+			"s:/users/{id}":     Simple{Targets: Addresses{Address{0, 4}}},
+		},
+		Shards: map[string]Sharded{
+			"s:/tenant/{id}/billing": Sharded{
+				ShardEntry{From: "a", To: "m", Targets: Addresses{Address{1, 1}}},
+				ShardEntry{From: "n", To: "zzzz", Targets: Addresses{Address{1, 2}}},
+			},
+		},
+	})
+	check("s:/users/42/avatar", Addresses{Address{0, 2}}, routing, t)
+	check("s:/users/42/avatar/large", Addresses{Address{0, 2}}, routing, t)
+	check("s:/users/42/profile", Addresses{Address{0, 4}}, routing, t)
+	check("s:/users", Addresses{Address{0, 1}}, routing, t)
+	check("s:/billing/a/b/health", Addresses{Address{0, 3}}, routing, t)
+	check("s:/tenant/alice/billing/2016", Addresses{Address{1, 1}}, routing, t)
+	check("s:/tenant/zoe/billing", Addresses{Address{1, 2}}, routing, t)
+	check("s:/tenant/zoe/orders", Addresses{}, routing, t)
+	routing.RemoveRule("s:/users/*/avatar")
+	check("s:/users/42/avatar", Addresses{Address{0, 4}}, routing, t)
+}
+
+func TestRoutingTreeUpdatesAreAtomic(t *testing.T) {
+	routing := NewRoutingTree()
+	update := func(target Address) RoutingTreeUpdate {
+		return RoutingTreeUpdate{
+			Services: map[string]Simple{
+				"s:/a": Simple{Targets: Addresses{target}},
+				"s:/b": Simple{Targets: Addresses{target}},
+			},
+		}
+	}
+	routing.Apply(update(Address{0, 1}))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		for i := uint32(2); ; i++ {
+			select {
+			case <-stop:
+				close(done)
+				return
+			default:
+				routing.Apply(update(Address{0, i}))
+			}
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		table := routing.load()
+		a, _ := table.match("s:/a")
+		b, _ := table.match("s:/b")
+		if !reflect.DeepEqual(a.item, b.item) {
+			t.Fatalf("Partial update visible: %v and %v", a.item, b.item)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func benchmarkRoutingTree() *RoutingTree {
+	routing := NewRoutingTree()
+	update := RoutingTreeUpdate{Services: make(map[string]Simple), Shards: make(map[string]Sharded)}
+	for i := 0; i < 100; i++ {
+		update.Services["s:/service"+strconv.Itoa(i)] = Simple{Targets: Addresses{Address{0, uint32(i)}}}
+	}
+	update.Shards["s:/shard/"] = Sharded{
+		ShardEntry{From: "0000", To: "4999", Targets: Addresses{Address{0, 1}}},
+		ShardEntry{From: "5000", To: "9999", Targets: Addresses{Address{0, 2}}},
+	}
+	routing.Apply(update)
+	return routing
+}
+
+func BenchmarkRoute(b *testing.B) {
+	routing := benchmarkRoutingTree()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			routing.Route(MustParseDestination("s:/service42/toto/tata"))
+			routing.Route(MustParseDestination("s:/shard/6000/tata"))
+		}
+	})
+}
+
+func BenchmarkRouteConcurrentUpdates(b *testing.B) {
+	routing := benchmarkRoutingTree()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				close(done)
+				return
+			case <-time.After(time.Millisecond):
+				routing.UpsertSimpleRule("s:/service42", Simple{Targets: Addresses{Address{0, uint32(i)}}})
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			routing.Route(MustParseDestination("s:/service42/toto/tata"))
+			routing.Route(MustParseDestination("s:/shard/6000/tata"))
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func TestRoutingTreeUpdateValidate(t *testing.T) {
+	update := RoutingTreeUpdate{}
+	err := json.Unmarshal([]byte(`{
+		"Services": {
+			"s:/empty": {"targets": []},
+			"s:/ok": {"targets": [0.1]},
+			"s:/bad/{id": {"targets": [0.1]}
+		},
+		"service": {},
+		"shards": {
+			"s:/ok": [{"from": "0000", "to": "0010", "targets": [0.1]}],
+			"s:/shard/": [
+				{"from": "0000", "to": "0010", "targets": [0.1]},
+				{"from": "0010", "to": "0019", "targets": [0.2]},
+				{"from": "0030", "to": "0020", "targets": [0.3]},
+				{"from": "0040", "to": "0050", "targets": [0.3]}
+			]
+		}
+	}`), &update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validation := update.Validate()
+	expected := Validation{
+		Errors: []string{
+			`unknown section "service"`,
+			`s:/bad/{id: malformed wildcard segment "{id"`,
+			`s:/ok: declared in several sections [services shards]`,
+			`s:/empty: no targets`,
+			`s:/shard/[0010-0019]: overlaps s:/shard/[0000-0010]`,
+			`s:/shard/[0030-0020]: inverted range`,
+		},
+		Warnings: []string{
+			`s:/shard/[0030-0020]: gap after s:/shard/[0010-0019]`,
+			`s:/shard/[0040-0050]: gap after s:/shard/[0030-0020]`,
+		},
+	}
+	if !reflect.DeepEqual(validation, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, validation)
+	}
+	if validation.Err() == nil {
+		t.Error("Expected validation errors")
+	}
+}
+
+func TestValidateNestedShards(t *testing.T) {
+	update := RoutingTreeUpdate{Shards: map[string]Sharded{"s:/shard/": Sharded{
+		ShardEntry{From: "0000", To: "9999", Targets: Addresses{Address{0, 1}}},
+		ShardEntry{From: "1000", To: "2000", Targets: Addresses{Address{0, 2}}},
+		ShardEntry{From: "3000", To: "4000", Targets: Addresses{Address{0, 3}}},
+	}}}
+	validation := update.Validate()
+	expected := Validation{Errors: []string{
+		`s:/shard/[1000-2000]: overlaps s:/shard/[0000-9999]`,
+		`s:/shard/[3000-4000]: overlaps s:/shard/[0000-9999]`,
+	}}
+	if !reflect.DeepEqual(validation, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, validation)
+	}
+}
+
+func TestRoutingTreeExplain(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.Apply(RoutingTreeUpdate{
+		Services: map[string]Simple{
+			"s:/test1": Simple{Targets: Addresses{Address{0, 1}}},
+		},
+		Shards: map[string]Sharded{
+			"s:/tenant/{id}/billing": Sharded{
+				ShardEntry{From: "a", To: "m", Targets: Addresses{Address{1, 1}}},
+				ShardEntry{From: "n", To: "zzzz", Targets: Addresses{Address{1, 2}}},
+			},
+		},
+	})
+	e := routing.Explain("s:/tenant/zoe/billing/2016")
+	if e.Type != "sharded" || e.Prefix != "s:/tenant/{id}/billing" || e.ShardKey != "zoe" || e.Shard == nil || e.Shard.From != "n" {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+	if !reflect.DeepEqual(e.Route, routing.Route(MustParseDestination("s:/tenant/zoe/billing/2016"))) {
+		t.Errorf("Explanation route %v differs from Route", e.Route)
+	}
+	e = routing.Explain("s:/test1/toto")
+	if e.Type != "simple" || e.Prefix != "s:/test1" || e.Route.Addresses[0] != (Address{0, 1}) {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+	e = routing.Explain("x:0/4/reply")
+	if e.Type != "explicit" || e.Route.Addresses[0] != (Address{0, 4}) {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+	e = routing.Explain("s:/nowhere")
+	if e.Type != "" || len(e.Route.Addresses) != 0 {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"math/rand"
+	"strconv"
+)
+
+// A Simple rule with Groups splits new streams between its target groups in
+// proportion to their weights, e.g. 5% to a canary and 95% to the current
+// version. When the rule key captures its SplitKey, the group is derived from
+// the captured value so a value always lands in the same group, otherwise it
+// is picked at random. A value is mapped to a point of the total weight, so as
+// long as the total stays the same raising the weight of a group only moves
+// values into that group.
+
+// TargetGroup is a weighted set of targets of a Simple rule
+type TargetGroup struct {
+	// Name identifies the group in routes and metrics, it defaults to the
+	// index of the group
+	Name    string    `json:"name,omitempty"`
+	Weight  int       `json:"weight"`
+	Targets Addresses `json:"targets,omitempty"`
+	// Policy balances the targets of the group, it defaults to the policy
+	// of the rule
+	Policy Policy `json:"policy,omitempty"`
+}
+
+func (s *Simple) groupName(i int) string {
+	if s.Groups[i].Name != "" {
+		return s.Groups[i].Name
+	}
+	return strconv.Itoa(i)
+}
+
+func (s *Simple) totalWeight() int {
+	total := 0
+	for _, g := range s.Groups {
+		if g.Weight > 0 {
+			total += g.Weight
+		}
+	}
+	return total
+}
+
+// pickGroup returns the index of the group of a new stream, derived from key
+// when keyed, or -1 if no group has a weight
+func (s *Simple) pickGroup(key string, keyed bool) int {
+	total := s.totalWeight()
+	if total == 0 {
+		return -1
+	}
+	var point int
+	if keyed {
+		point = int(hashKey(key) % uint64(total))
+	} else {
+		point = rand.Intn(total)
+	}
+	for i, g := range s.Groups {
+		if g.Weight <= 0 {
+			continue
+		}
+		if point < g.Weight {
+			return i
+		}
+		point -= g.Weight
+	}
+	return -1
+}
+
+func validateGroups(v *Validation, prefix string, service Simple) {
+	if len(service.Targets) > 0 {
+		v.errorf("%v: targets and groups can not be both set", prefix)
+	}
+	if !service.Policy.valid() {
+		v.errorf("%v: unknown balancing policy %q", prefix, service.Policy)
+	}
+	names := make(map[string]bool)
+	for i, g := range service.Groups {
+		name := service.groupName(i)
+		if names[name] {
+			v.errorf("%v: duplicate group %v", prefix, name)
+		}
+		names[name] = true
+		rule := prefix + "#" + name
+		validateTargets(v, rule, g.Targets, g.Policy)
+		if g.Weight < 0 {
+			v.errorf("%v: negative weight %v", rule, g.Weight)
+		}
+	}
+	if service.totalWeight() == 0 {
+		v.errorf("%v: no group has a weight", prefix)
+	}
+	if service.SplitKey != "" && !compilePattern(prefix).captures(service.SplitKey) {
+		v.warnf("%v: split key %q is not captured, groups are picked at random", prefix, service.SplitKey)
+	}
+}
+
+// split returns the route to the group of rule picked for match, every group
+// is balanced separately
+func (t *routingTable) split(match ruleMatch, rule Simple, explanation *Explanation) Route {
+	key, keyed := "", false
+	if rule.SplitKey != "" {
+		key, keyed = match.capture(rule.SplitKey)
+	}
+	i := rule.pickGroup(key, keyed)
+	if i < 0 {
+		return Route{Rule: match.key}
+	}
+	group := rule.Groups[i]
+	name := rule.groupName(i)
+	if explanation != nil {
+		explanation.SplitKey = key
+		explanation.Group = name
+	}
+	policy := group.Policy
+	if policy == "" {
+		policy = rule.Policy
+	}
+	return Route{Rule: match.key + "#" + name, Addresses: group.Targets, Policy: policy, Broadcast: rule.Broadcast}
+}
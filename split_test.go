@@ -0,0 +1,112 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func canary(weight int) Simple {
+	return Simple{SplitKey: "user", Groups: []TargetGroup{
+		{Name: "v2", Weight: weight, Targets: Addresses{Address{0, 7}}},
+		{Name: "v1", Weight: 100 - weight, Targets: Addresses{Address{0, 3}}},
+	}}
+}
+
+func TestSplitIsDeterministic(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/users/{user}", canary(5))
+	keys := 10000
+	before := make(map[string]string)
+	canaries := 0
+	for i := 0; i < keys; i++ {
+		dest := MustParseDestination("s:/users/" + strconv.Itoa(i) + "/profile")
+		route := routing.Route(dest)
+		if again := routing.Route(dest); again.Rule != route.Rule {
+			t.Fatalf("%v routed to %v then %v", dest, route.Rule, again.Rule)
+		}
+		before[dest.String()] = route.Rule
+		if route.Rule == "s:/users/{user}#v2" {
+			canaries++
+			if route.Addresses[0] != (Address{0, 7}) {
+				t.Errorf("Expected the canary target, got %v", route.Addresses)
+			}
+		}
+	}
+	if canaries < keys/40 || canaries > keys/10 {
+		t.Errorf("Expected about 5%% of the keys in the canary, got %v of %v", canaries, keys)
+	}
+	routing.UpsertSimpleRule("s:/users/{user}", canary(20))
+	for dest, rule := range before {
+		if rule == "s:/users/{user}#v2" && routing.Route(MustParseDestination(dest)).Rule != rule {
+			t.Errorf("%v left the canary when its weight was raised", dest)
+		}
+	}
+}
+
+func TestSplitIsWeighted(t *testing.T) {
+	routing := NewRoutingTree()
+	rule := canary(25)
+	rule.SplitKey = ""
+	routing.UpsertSimpleRule("s:/users/", rule)
+	streams := 10000
+	canaries := 0
+	for i := 0; i < streams; i++ {
+		if routing.Route(MustParseDestination("s:/users/42")).Rule == "s:/users/#v2" {
+			canaries++
+		}
+	}
+	if canaries < streams/5 || canaries > streams*3/10 {
+		t.Errorf("Expected about 25%% of the streams in the canary, got %v of %v", canaries, streams)
+	}
+	routing.UpsertSimpleRule("s:/users/", canary(0))
+	check("s:/users/42", Addresses{Address{0, 3}}, routing, t)
+}
+
+func TestSplitExplain(t *testing.T) {
+	routing := NewRoutingTree()
+	routing.UpsertSimpleRule("s:/users/{user}", canary(100))
+	e := routing.Explain("s:/users/42")
+	if e.Group != "v2" || e.SplitKey != "42" || e.Route.Rule != "s:/users/{user}#v2" {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+}
+
+func TestSplitValidate(t *testing.T) {
+	update := RoutingTreeUpdate{Services: map[string]Simple{
+		"s:/a/": {Targets: Addresses{Address{0, 1}}, Groups: canary(5).Groups},
+		"s:/b/": {Groups: []TargetGroup{{Name: "x", Weight: 1, Targets: Addresses{Address{0, 1}}}, {Name: "x", Weight: -1}}},
+		"s:/c/": {Groups: []TargetGroup{{Targets: Addresses{Address{0, 1}}}}},
+		"s:/d/": canary(5),
+		"s:/e/": {Targets: Addresses{Address{0, 1}}, SplitKey: "user"},
+	}}
+	v := update.Validate()
+	errors := strings.Join(v.Errors, "\n")
+	for _, expected := range []string{"s:/a/: targets and groups", "s:/b/: duplicate group x", "s:/b/#x: no targets", "s:/b/#x: negative weight", "s:/c/: no group has a weight"} {
+		if !strings.Contains(errors, expected) {
+			t.Errorf("Expected error %q in %v", expected, v.Errors)
+		}
+	}
+	if len(v.Errors) != 5 {
+		t.Errorf("Unexpected errors %v", v.Errors)
+	}
+	warnings := strings.Join(v.Warnings, "\n")
+	if !strings.Contains(warnings, "s:/d/: split key \"user\" is not captured") || !strings.Contains(warnings, "s:/e/: split key without groups") {
+		t.Errorf("Unexpected warnings %v", v.Warnings)
+	}
+}
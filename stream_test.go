@@ -16,9 +16,11 @@ limitations under the License.
 package hyenad
 
 import (
+	"bufio"
 	"bytes"
 	log "github.com/Sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -31,7 +33,7 @@ func TestFrameStream(t *testing.T) {
 	reader := bytes.NewReader([]byte(LongString))
 	id := CreateMid(0, 0, 0)
 	frames := make(chan *Frame)
-	writeStream := NewWriteStream(id, "/test/toto/tata", frames)
+	writeStream := NewWriteStream(id, MustParseDestination("s:/test/toto/tata"), frames)
 	go func() {
 		io.Copy(writeStream, reader)
 		writeStream.Close()
@@ -55,8 +57,8 @@ func TestFrameStream(t *testing.T) {
 		log.WithError(err).Error("Creating ReadStream")
 		t.Fail()
 	}
-	if readStream.Destination() != "/test/toto/tata" {
-		log.WithField("Destination", readStream.Destination()).Error("Expected /test/toto/tata")
+	if readStream.Destination() != "s:/test/toto/tata" {
+		log.WithField("Destination", readStream.Destination()).Error("Expected s:/test/toto/tata")
 		t.Fail()
 	}
 	if readStream.MessageId() != id {
@@ -73,3 +75,82 @@ func TestFrameStream(t *testing.T) {
 		log.WithField("Frames", atomic.LoadUint32(&count)).Info("Round Trip ok")
 	}
 }
+
+func TestLargeFrames(t *testing.T) {
+	InitFrameBuffers()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	frames := make(chan *Frame, 64)
+	stream := NewWriteStream(CreateMid(0, 0, 1), MustParseDestination("s:/bulk"), frames)
+	if err := stream.SetFrameSize(MaxFrameSize + 1); err == nil {
+		t.Errorf("Expected frame sizes over MaxFrameSize to be rejected")
+	}
+	if err := stream.SetFrameSize(MaxFrameSize); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stream.Write(data)
+		stream.Close()
+		close(frames)
+	}()
+	// Frames go through the wire format and back
+	wire := bytes.Buffer{}
+	count := 0
+	for f := range frames {
+		if len(f.Buffer()) > MaxFrameSize {
+			t.Errorf("Frame of %v bytes", len(f.Buffer()))
+		}
+		if err := writeFrame(&wire, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Release()
+		count++
+	}
+	if count != len(data)/(MaxFrameSize-FrameHeaderSize)+1 {
+		t.Errorf("Expected frames of MaxFrameSize, got %v frames for %v bytes", count, len(data))
+	}
+	reader := bufio.NewReader(&wire)
+	received := make(chan *Frame, count)
+	for i := 0; i < count; i++ {
+		f, err := readFrame(reader, MaxFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received <- f
+	}
+	close(received)
+	readStream, err := NewReadStream(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTripped, _ := ioutil.ReadAll(&readStream)
+	if readStream.Destination() != "s:/bulk" || !bytes.Equal(roundTripped, data) {
+		t.Errorf("Round trip failed, got %v bytes to %v", len(roundTripped), readStream.Destination())
+	}
+}
+
+func TestReadFrameRejectsOversizedFrames(t *testing.T) {
+	InitFrameBuffers()
+	f, err := NewFrame(FrameHeader{Id: CreateMid(0, 0, 1), Flags: FIRSTFRAME | LASTFRAME, Dest: "s:/test"}, make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := bytes.Buffer{}
+	writeFrame(&wire, &f)
+	if _, err := readFrame(bufio.NewReader(&wire), MinFrameSize); err == nil {
+		t.Errorf("Expected a frame over the maximum size to be rejected")
+	}
+	if _, err := NewFrame(FrameHeader{Flags: FIRSTFRAME, Dest: "s:/" + strings.Repeat("a", MaxDestinationSize)}, nil); err == nil {
+		t.Errorf("Expected destinations over MaxDestinationSize to be rejected")
+	}
+}
+
+func TestSizedBuffers(t *testing.T) {
+	buffers := InitFrameBuffers()
+	for _, size := range []int{10, 256, 257, 4096, MaxFrameSize} {
+		buf := buffers.Get(size)
+		if cap(buf) < size || cap(buf) > MaxFrameSize || len(buf) != 0 {
+			t.Errorf("Got a buffer of %v/%v bytes for %v bytes", len(buf), cap(buf), size)
+		}
+		buffers.Return(buf)
+	}
+}
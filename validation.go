@@ -0,0 +1,275 @@
+/*
+Copyright 2016 Assoba S.A.S.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hyenad
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var updateSections = []string{"delete", "services", "shards", "hashShards", "rewrites", "deadLetter"}
+
+func (u *RoutingTreeUpdate) UnmarshalJSON(input []byte) error {
+	type plain RoutingTreeUpdate
+	err := json.Unmarshal(input, (*plain)(u))
+	if err != nil {
+		return err
+	}
+	sections := make(map[string]json.RawMessage)
+	err = json.Unmarshal(input, &sections)
+	if err != nil {
+		return err
+	}
+	u.unknown = nil
+next:
+	for name := range sections {
+		for _, known := range updateSections {
+			// Like encoding/json, match section names case insensitively
+			if strings.EqualFold(name, known) {
+				continue next
+			}
+		}
+		u.unknown = append(u.unknown, name)
+	}
+	sort.Strings(u.unknown)
+	return nil
+}
+
+// Validation lists the problems found in a RoutingTreeUpdate. Errors make the
+// update unsafe to apply, warnings point at probable mistakes.
+type Validation struct {
+	Errors   []string `json:"errors,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Err returns the errors of the validation as an error, or nil if there are none
+func (v Validation) Err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid routing update: %v", strings.Join(v.Errors, ", "))
+}
+
+func (v *Validation) errorf(format string, args ...interface{}) {
+	v.Errors = append(v.Errors, fmt.Sprintf(format, args...))
+}
+
+func (v *Validation) warnf(format string, args ...interface{}) {
+	v.Warnings = append(v.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the rules of the update: unknown sections, prefixes declared
+// in several sections, malformed wildcards, empty targets, unknown policies,
+// inverted and overlapping shard ranges, malformed target groups, wildcard,
+// empty and looping rewrites, malformed dead-letter destinations are errors,
+// gaps between shard ranges, split keys that are never captured and rules
+// shadowed by a rewrite are warnings.
+func (u *RoutingTreeUpdate) Validate() Validation {
+	v := Validation{}
+	for _, name := range u.unknown {
+		v.errorf("unknown section %q", name)
+	}
+	sections := make(map[string][]string)
+	for prefix := range u.Services {
+		sections[prefix] = append(sections[prefix], "services")
+	}
+	for prefix := range u.Shards {
+		sections[prefix] = append(sections[prefix], "shards")
+	}
+	for prefix := range u.HashShards {
+		sections[prefix] = append(sections[prefix], "hashShards")
+	}
+	for _, prefix := range sortedKeys(sections) {
+		if len(sections[prefix]) > 1 {
+			v.errorf("%v: declared in several sections %v", prefix, sections[prefix])
+		}
+		validatePattern(&v, prefix)
+	}
+	for _, prefix := range sortedKeys(u.Services) {
+		service := u.Services[prefix]
+		if len(service.Groups) > 0 {
+			validateGroups(&v, prefix, service)
+			continue
+		}
+		validateTargets(&v, prefix, service.Targets, service.Policy)
+		if service.SplitKey != "" {
+			v.warnf("%v: split key without groups", prefix)
+		}
+	}
+	for _, prefix := range sortedKeys(u.Shards) {
+		validateShards(&v, prefix, u.Shards[prefix])
+	}
+	for _, prefix := range sortedKeys(u.HashShards) {
+		shard := u.HashShards[prefix]
+		validateTargets(&v, prefix, shard.Targets, "")
+		if shard.Replicas < 0 {
+			v.errorf("%v: negative replicas %v", prefix, shard.Replicas)
+		}
+	}
+	validateRewrites(&v, u)
+	if u.DeadLetter != nil && *u.DeadLetter != "" {
+		if _, err := ParseDestination(*u.DeadLetter); err != nil {
+			v.errorf("deadLetter: %v", err)
+		}
+		for _, source := range sortedKeys(u.Rewrites) {
+			if strings.HasPrefix(*u.DeadLetter, source) {
+				v.errorf("deadLetter: %v is rewritten by %v", *u.DeadLetter, source)
+			}
+		}
+	}
+	return v
+}
+
+func validatePattern(v *Validation, key string) {
+	for _, segment := range strings.Split(key, "/") {
+		if isWildcard(segment) {
+			continue
+		}
+		if strings.ContainsAny(segment, "*{}") {
+			v.errorf("%v: malformed wildcard segment %q", key, segment)
+		}
+	}
+}
+
+func validateTargets(v *Validation, rule string, targets Addresses, policy Policy) {
+	if len(targets) == 0 {
+		v.errorf("%v: no targets", rule)
+	}
+	if !policy.valid() {
+		v.errorf("%v: unknown balancing policy %q", rule, policy)
+	}
+}
+
+func validateShards(v *Validation, prefix string, shards Sharded) {
+	if len(shards) == 0 {
+		v.errorf("%v: no shard ranges", prefix)
+		return
+	}
+	sorted := make(Sharded, len(shards))
+	copy(sorted, shards)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].From < sorted[j].From
+	})
+	alphabet := keyAlphabet(shards)
+	// reach is the range reaching the furthest among the ones before s, s
+	// starts a gap or an overlap with it
+	var reach ShardEntry
+	for i, s := range sorted {
+		rule := fmt.Sprintf("%v[%v-%v]", prefix, s.From, s.To)
+		validateTargets(v, rule, s.Targets, s.Policy)
+		if s.From > s.To {
+			v.errorf("%v: inverted range", rule)
+		}
+		if i > 0 {
+			if s.From <= reach.To {
+				v.errorf("%v: overlaps %v[%v-%v]", rule, prefix, reach.From, reach.To)
+			} else if !adjacentKeys(alphabet, reach.To, s.From) {
+				v.warnf("%v: gap after %v[%v-%v]", rule, prefix, reach.From, reach.To)
+			}
+		}
+		if i == 0 || s.To > reach.To {
+			reach = s
+		}
+	}
+}
+
+// keyAlphabets are the alphabets shard keys are assumed to be written in, in
+// key order
+var keyAlphabets = []string{
+	"0123456789",
+	"0123456789abcdef",
+	"0123456789ABCDEF",
+	"abcdefghijklmnopqrstuvwxyz",
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"0123456789abcdefghijklmnopqrstuvwxyz",
+	"0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+}
+
+// keyAlphabet returns the smallest alphabet holding every character of the
+// bounds of shards, or "" when none does
+func keyAlphabet(shards Sharded) string {
+	for _, alphabet := range keyAlphabets {
+		holds := true
+		for _, shard := range shards {
+			if strings.Trim(shard.From, alphabet) != "" || strings.Trim(shard.To, alphabet) != "" {
+				holds = false
+				break
+			}
+		}
+		if holds {
+			return alphabet
+		}
+	}
+	return ""
+}
+
+// adjacentKeys returns true if no key written in alphabet sorts between a and
+// b, b being the key following a with the width of a: 7fff and 8000 in hex.
+// Keys outside the known alphabets use successor.
+func adjacentKeys(alphabet string, a string, b string) bool {
+	if alphabet == "" {
+		return b == successor(a)
+	}
+	if len(a) != len(b) {
+		return false
+	}
+	next := []byte(a)
+	for i := len(next) - 1; i >= 0; i-- {
+		digit := strings.IndexByte(alphabet, next[i])
+		if digit < len(alphabet)-1 {
+			next[i] = alphabet[digit+1]
+			return string(next) == b
+		}
+		next[i] = alphabet[0]
+	}
+	return false
+}
+
+// successor returns the key following key for fixed width keys, digits and
+// letters carry over like in a number: successor("0019") is "0020".
+func successor(key string) string {
+	res := []byte(key)
+	for i := len(res) - 1; i >= 0; i-- {
+		switch res[i] {
+		case '9':
+			res[i] = '0'
+		case 'z':
+			res[i] = 'a'
+		case 'Z':
+			res[i] = 'A'
+		case 0xff:
+			res[i] = 0
+		default:
+			res[i]++
+			return string(res)
+		}
+	}
+	// Every character carried over, the successor is longer
+	return string(append([]byte{0}, res...))
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	res := make([]string, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, k.String())
+	}
+	sort.Strings(res)
+	return res
+}
@@ -17,45 +17,125 @@ package hyenad
 
 import (
 	"errors"
+	"fmt"
 )
 
 type WriteStream struct {
-	Id      MsgId
-	dest    string
-	frameId uint64
-	closed  bool
-	toSend  []byte
-	output  chan<- *Frame
+	Id        MsgId
+	dest      Destination
+	frameId   uint64
+	closed    bool
+	toSend    []byte
+	output    chan<- *Frame
+	frameSize int
+	// maxFrameSize is the largest frame size of the connection of the stream
+	maxFrameSize int
+	headers      Headers
+	// headersSent is set once the header block is queued
+	headersSent bool
+	// aborts records the abort of the streams of a HyenaClient by hyenad
+	aborts *writeAborts
 }
 
-func NewWriteStream(id MsgId, dest string, output chan<- *Frame) *WriteStream {
-	res := WriteStream{Id: id, dest: dest}
+func NewWriteStream(id MsgId, dest Destination, output chan<- *Frame) *WriteStream {
+	res := WriteStream{Id: id, dest: dest, frameSize: DEFAULT_FRAME_SIZE, maxFrameSize: MaxFrameSize}
 	res.output = output
 	res.toSend = make([]byte, 0, 128)
 	return &res
 }
 
+func (s *WriteStream) Destination() Destination {
+	return s.dest
+}
+
+// SetFrameSize sets the size of the frames of the stream, header included,
+// from MinFrameSize to the max frame size of its connection. Large frames cut
+// the overhead of bulk transfers, it must be set before anything is written.
+func (s *WriteStream) SetFrameSize(size int) error {
+	if size < MinFrameSize || size > s.maxFrameSize {
+		return fmt.Errorf("Frame size %v out of %v-%v", size, MinFrameSize, s.maxFrameSize)
+	}
+	if s.frameId > 0 || len(s.toSend) > 0 {
+		return errors.New("Frame size set after writing to the stream")
+	}
+	s.frameSize = size
+	return nil
+}
+
+// SetHeader sets a header of the stream, headers must be set before anything
+// is written
+func (s *WriteStream) SetHeader(key string, value string) error {
+	if key == "" {
+		return errors.New("Empty header key")
+	}
+	if s.frameId > 0 || len(s.toSend) > 0 || s.headersSent {
+		return errors.New("Header set after writing to the stream")
+	}
+	if s.headers == nil {
+		s.headers = make(Headers)
+	}
+	previous, existed := s.headers[key]
+	s.headers[key] = value
+	if len(encodeHeaders(s.headers)) > MaxHeadersSize {
+		if existed {
+			s.headers[key] = previous
+		} else {
+			delete(s.headers, key)
+		}
+		return fmt.Errorf("Headers larger than %v bytes", MaxHeadersSize)
+	}
+	return nil
+}
+
+// queueHeaders puts the header block before the contents of the stream
+func (s *WriteStream) queueHeaders() {
+	if s.headersSent || len(s.headers) == 0 {
+		return
+	}
+	s.headersSent = true
+	s.toSend = append(encodeHeaders(s.headers), s.toSend...)
+}
+
+// room returns the size of the contents of the next frame
+func (s *WriteStream) room() int {
+	if s.frameId == 0 {
+		return s.frameSize - FrameHeaderSize - (len(s.dest.String()) + 1)
+	}
+	return s.frameSize - FrameHeaderSize
+}
+
+// Write sends the full frames of the written data, the last frame is kept
+// until the stream is flushed
 func (s *WriteStream) Write(p []byte) (n int, err error) {
+	if err := s.abortReason(); err != nil {
+		return 0, err
+	}
+	s.queueHeaders()
 	s.toSend = append(s.toSend, p...)
-	if len(s.toSend) > MaxFrameSize-FrameHeaderSize {
-		n2, frame, err2 := s.writeFrame(s.toSend, false)
+	sent := 0
+	for len(s.toSend)-sent > s.room() {
+		n2, frame, err2 := s.writeFrame(s.toSend[sent:], 0)
 		if err2 != nil {
 			err = err2
-		} else {
-			remaining := len(s.toSend) - n2
-			copy(s.toSend, s.toSend[n2:n2+remaining])
-			s.toSend = s.toSend[0:remaining]
-			s.output <- frame
+			break
 		}
+		sent += n2
+		s.output <- frame
 	}
+	remaining := copy(s.toSend, s.toSend[sent:])
+	s.toSend = s.toSend[0:remaining]
 	return len(p), err
 }
 
 func (s *WriteStream) Flush(close bool) error {
+	if err := s.abortReason(); err != nil {
+		return err
+	}
+	s.queueHeaders()
 	remaining := len(s.toSend)
 	sent := 0
 	for remaining > 0 {
-		n, frame, err := s.writeFrame(s.toSend, false)
+		n, frame, err := s.writeFrame(s.toSend, 0)
 		if err != nil {
 			return err
 		}
@@ -64,8 +144,8 @@ func (s *WriteStream) Flush(close bool) error {
 			// Redo last frame to close stream
 			// Rollback frame
 			s.frameId = s.frameId - 1
-			frameBuffers.Return(frame.buffer)
-			n, frame, err = s.writeFrame(s.toSend, true)
+			frame.Release()
+			n, frame, err = s.writeFrame(s.toSend, LASTFRAME)
 		}
 		copy(s.toSend, s.toSend[n:n+remaining])
 		s.toSend = s.toSend[0:remaining]
@@ -74,7 +154,7 @@ func (s *WriteStream) Flush(close bool) error {
 	}
 	if sent == 0 {
 		// Damn, write an empty close frame
-		_, frame, err := s.writeFrame([]byte{}, true)
+		_, frame, err := s.writeFrame([]byte{}, LASTFRAME)
 		if err != nil {
 			return err
 		} else {
@@ -84,13 +164,61 @@ func (s *WriteStream) Flush(close bool) error {
 	return nil
 }
 
+// Close sends the end of the stream, it returns the reason hyenad aborted the
+// stream if it did
 func (s *WriteStream) Close() error {
+	if s.aborts != nil {
+		defer s.aborts.close(s.Id)
+	}
+	if err := s.abortReason(); err != nil {
+		s.closed = true
+		return err
+	}
 	s.Flush(true)
 	s.closed = true
 	return nil
 }
 
-func (s *WriteStream) writeFrame(p []byte, close bool) (n int, frame *Frame, err error) {
+// abortReason returns the error hyenad aborted the stream with, if any
+func (s *WriteStream) abortReason() error {
+	if s.aborts == nil {
+		return nil
+	}
+	return s.aborts.reason(s.Id)
+}
+
+// Abort ends the stream with an abort frame carrying the reason of the failure,
+// the contents not sent yet are dropped and readers get an *AbortError
+func (s *WriteStream) Abort(reason error) error {
+	if s.closed {
+		return errors.New("Stream closed")
+	}
+	if s.aborts != nil {
+		defer s.aborts.close(s.Id)
+	}
+	s.toSend = s.toSend[:0]
+	if s.frameId == 0 {
+		// The header block was dropped with the contents
+		s.headers = nil
+	}
+	message := ""
+	if reason != nil {
+		message = reason.Error()
+	}
+	if room := s.room(); len(message) > room {
+		message = message[:room]
+	}
+	_, frame, err := s.writeFrame([]byte(message), LASTFRAME|ABORT)
+	if err != nil {
+		return err
+	}
+	s.output <- frame
+	return nil
+}
+
+// writeFrame returns the next frame of the stream, end holds the flags of the
+// last frame when it closes the stream
+func (s *WriteStream) writeFrame(p []byte, end Flags) (n int, frame *Frame, err error) {
 	if s.closed {
 		return 0, nil, errors.New("Stream closed")
 	}
@@ -102,18 +230,21 @@ func (s *WriteStream) writeFrame(p []byte, close bool) (n int, frame *Frame, err
 	var remaining int
 	if header.FrameNumber == 0 {
 		header.Flags = FIRSTFRAME
-		if close {
-			header.Flags += LASTFRAME
+		if len(s.headers) > 0 {
+			header.Flags |= HEADERS
+		}
+		if end != 0 {
+			header.Flags |= end
 			s.closed = true
 		}
-		header.Dest = s.dest
-		remaining = MaxFrameSize - FrameHeaderSize - (len(s.dest) + 1)
+		header.Dest = s.dest.String()
+		remaining = s.frameSize - FrameHeaderSize - (len(header.Dest) + 1)
 	} else {
-		if close {
-			header.Flags = LASTFRAME
+		if end != 0 {
+			header.Flags = end
 			s.closed = true
 		}
-		remaining = MaxFrameSize - FrameHeaderSize
+		remaining = s.frameSize - FrameHeaderSize
 	}
 	if remaining > len(p) {
 		remaining = len(p)